@@ -1,6 +1,7 @@
 package cfg
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
@@ -15,8 +16,12 @@ import (
 )
 
 type SnapshotStoreType string
+type TableDirection string
+type FailurePolicy string
+type PayloadCodec string
 
 const NodeNamePrefix = "marmot-node"
+const DefaultConflictResolver = "lww"
 const EmbeddedClusterName = "e-marmot"
 const (
 	Nats   SnapshotStoreType = "nats"
@@ -24,13 +29,50 @@ const (
 	WebDAV SnapshotStoreType = "webdav"
 	SFTP   SnapshotStoreType = "sftp"
 )
+const (
+	Both          TableDirection = "both"
+	PublishOnly   TableDirection = "publish"
+	ReplicateOnly TableDirection = "replicate"
+)
+
+const (
+	HaltOnFailure       FailurePolicy = "halt"
+	DeadLetterOnFailure FailurePolicy = "dead-letter"
+)
+
+const (
+	NoCodec       PayloadCodec = "none"
+	ZstdCodec     PayloadCodec = "zstd"
+	S2Codec       PayloadCodec = "s2"
+	ZstdDictCodec PayloadCodec = "zstd-dict"
+)
+
+var ErrInvalidTablePattern = errors.New("invalid table pattern")
+var ErrInvalidTableDirection = errors.New("invalid table direction")
+var ErrInvalidFailurePolicy = errors.New("invalid failure policy")
+var ErrInvalidPayloadCodec = errors.New("invalid payload codec")
+var ErrInvalidMaxAckPending = errors.New("max_ack_pending is lower than apply_batch_size")
 
 type ReplicationLogConfiguration struct {
-	Shards         uint64 `toml:"shards"`
-	MaxEntries     int64  `toml:"max_entries"`
-	Replicas       int    `toml:"replicas"`
-	Compress       bool   `toml:"compress"`
-	UpdateExisting bool   `toml:"update_existing"`
+	Shards                 uint64        `toml:"shards"`
+	MaxEntries             int64         `toml:"max_entries"`
+	Replicas               int           `toml:"replicas"`
+	Compress               bool          `toml:"compress"`
+	UpdateExisting         bool          `toml:"update_existing"`
+	PublishAckWindow       int           `toml:"publish_ack_window"`
+	ApplyBatchSize         int           `toml:"apply_batch_size"`
+	MaxAckPending          int           `toml:"max_ack_pending"`
+	AckWait                int64         `toml:"ack_wait"`
+	DedupWindow            int64         `toml:"dedup_window"`
+	FailurePolicy          FailurePolicy `toml:"failure_policy"`
+	PublishMaxRetries      int           `toml:"publish_max_retries"`
+	PublishRetryBackoff    int64         `toml:"publish_retry_backoff"`
+	PublishRetryMaxBackoff int64         `toml:"publish_retry_max_backoff"`
+	DeferForeignKeys       bool          `toml:"defer_foreign_keys"`
+	TombstoneRetention     int64         `toml:"tombstone_retention"`
+	Codec                  PayloadCodec  `toml:"codec"`
+
+	Dictionaries map[string]string `toml:"dictionaries"`
 }
 
 type WebDAVConfiguration struct {
@@ -57,13 +99,18 @@ type ObjectStoreConfiguration struct {
 }
 
 type SnapshotConfiguration struct {
-	Enable    bool                     `toml:"enabled"`
-	Interval  uint32                   `toml:"interval"`
-	StoreType SnapshotStoreType        `toml:"store"`
-	Nats      ObjectStoreConfiguration `toml:"nats"`
-	S3        S3Configuration          `toml:"s3"`
-	WebDAV    WebDAVConfiguration      `toml:"webdav"`
-	SFTP      SFTPConfiguration        `toml:"sftp"`
+	Enable      bool                     `toml:"enabled"`
+	Interval    uint32                   `toml:"interval"`
+	KeepCount   int                      `toml:"keep_count"`
+	KeepDays    int                      `toml:"keep_days"`
+	Compress    bool                     `toml:"compress"`
+	Incremental bool                     `toml:"incremental"`
+	ChunkSize   int64                    `toml:"chunk_size"`
+	StoreType   SnapshotStoreType        `toml:"store"`
+	Nats        ObjectStoreConfiguration `toml:"nats"`
+	S3          S3Configuration          `toml:"s3"`
+	WebDAV      WebDAVConfiguration      `toml:"webdav"`
+	SFTP        SFTPConfiguration        `toml:"sftp"`
 }
 
 type NATSConfiguration struct {
@@ -82,6 +129,39 @@ type NATSConfiguration struct {
 	ReconnectWaitSeconds int      `toml:"reconnect_wait_seconds"`
 }
 
+type TablePolicyConfiguration struct {
+	Pattern   string         `toml:"pattern"`
+	Direction TableDirection `toml:"direction"`
+	Conflict  string         `toml:"conflict"`
+	ShardKey  string         `toml:"shard_key"`
+}
+
+type TablesConfiguration struct {
+	Include  []string                   `toml:"include"`
+	Exclude  []string                   `toml:"exclude"`
+	Policies []TablePolicyConfiguration `toml:"policy"`
+}
+
+type EncryptionConfiguration struct {
+	Enable  bool   `toml:"enable"`
+	Keyring string `toml:"keyring"`
+}
+
+type TrustedNodeConfiguration struct {
+	NodeID    uint64   `toml:"node_id"`
+	PublicKey string   `toml:"public_key"`
+	Tables    []string `toml:"tables"`
+}
+
+type SigningConfiguration struct {
+	Enable         bool   `toml:"enable"`
+	PrivateKey     string `toml:"private_key"`
+	Verify         bool   `toml:"verify"`
+	QuarantinePath string `toml:"quarantine_path"`
+
+	Trusted []TrustedNodeConfiguration `toml:"trusted"`
+}
+
 type LoggingConfiguration struct {
 	Verbose bool   `toml:"verbose"`
 	Format  string `toml:"format"`
@@ -107,14 +187,24 @@ type Configuration struct {
 
 	Snapshot       SnapshotConfiguration       `toml:"snapshot"`
 	ReplicationLog ReplicationLogConfiguration `toml:"replication_log"`
+	Tables         TablesConfiguration         `toml:"tables"`
 	NATS           NATSConfiguration           `toml:"nats"`
+	Encryption     EncryptionConfiguration     `toml:"encryption"`
+	Signing        SigningConfiguration        `toml:"signing"`
 	Logging        LoggingConfiguration        `toml:"logging"`
 	Prometheus     PrometheusConfiguration     `toml:"prometheus"`
 }
 
 var ConfigPathFlag = flag.String("config", "", "Path to configuration file")
 var CleanupFlag = flag.Bool("cleanup", false, "Only cleanup marmot triggers and changelogs")
+var RequeueFailedFlag = flag.Bool("requeue-failed", false, "Only requeue changes that failed publishing")
 var SaveSnapshotFlag = flag.Bool("save-snapshot", false, "Only take snapshot and upload")
+var ListSnapshotsFlag = flag.Bool("list-snapshots", false, "Only list snapshot versions")
+var RestoreSnapshotFlag = flag.String("restore-snapshot", "", "Restore given snapshot version, or latest valid one with \"latest\", before starting")
+var ReshardFlag = flag.Uint64("reshard", 0, "Only reshard replication log of cluster to given number of shards")
+var DeadLetterFlag = flag.String("dead-letter", "", "Only manage dead-letter entries: list | retry | discard")
+var DeadLetterSeqFlag = flag.Uint64("dead-letter-seq", 0, "Dead-letter entry to retry or discard (default: all entries of this node)")
+var GenSigningKeyFlag = flag.String("gen-signing-key", "", "Only generate signing key to given path and print its public key")
 var ClusterAddrFlag = flag.String("cluster-addr", "", "Cluster listening address")
 var ClusterPeersFlag = flag.String("cluster-peers", "", "Comma separated list of clusters")
 var LeafServerFlag = flag.String("leaf-servers", "", "Comma separated list of leaf servers")
@@ -135,6 +225,10 @@ var Config = &Configuration{
 	Snapshot: SnapshotConfiguration{
 		Enable:    true,
 		Interval:  0,
+		KeepCount: 3,
+		KeepDays:  0,
+		Compress:  true,
+		ChunkSize: 4 * 1024 * 1024,
 		StoreType: Nats,
 		Nats: ObjectStoreConfiguration{
 			Replicas: 1,
@@ -145,11 +239,30 @@ var Config = &Configuration{
 	},
 
 	ReplicationLog: ReplicationLogConfiguration{
-		Shards:         1,
-		MaxEntries:     1024,
-		Replicas:       1,
-		Compress:       true,
-		UpdateExisting: false,
+		Shards:                 1,
+		MaxEntries:             1024,
+		Replicas:               1,
+		Compress:               true,
+		UpdateExisting:         false,
+		PublishAckWindow:       256,
+		ApplyBatchSize:         1,
+		MaxAckPending:          1024,
+		AckWait:                30000,
+		DedupWindow:            120000,
+		FailurePolicy:          HaltOnFailure,
+		PublishMaxRetries:      10,
+		PublishRetryBackoff:    500,
+		PublishRetryMaxBackoff: 60000,
+		DeferForeignKeys:       false,
+		TombstoneRetention:     86400000,
+		Codec:                  "",
+		Dictionaries:           map[string]string{},
+	},
+
+	Tables: TablesConfiguration{
+		Include:  []string{},
+		Exclude:  []string{},
+		Policies: []TablePolicyConfiguration{},
 	},
 
 	NATS: NATSConfiguration{
@@ -165,6 +278,19 @@ var Config = &Configuration{
 		ReconnectWaitSeconds: 2,
 	},
 
+	Encryption: EncryptionConfiguration{
+		Enable:  false,
+		Keyring: "",
+	},
+
+	Signing: SigningConfiguration{
+		Enable:         false,
+		PrivateKey:     "",
+		Verify:         false,
+		QuarantinePath: "",
+		Trusted:        []TrustedNodeConfiguration{},
+	},
+
 	Logging: LoggingConfiguration{
 		Verbose: false,
 		Format:  "console",
@@ -213,7 +339,54 @@ func Load(filePath string) error {
 		Config.SeqMapPath = path.Join(DataRootDir, "seq-map.cbor")
 	}
 
-	return nil
+	if Config.Signing.QuarantinePath == "" {
+		Config.Signing.QuarantinePath = path.Join(DataRootDir, "quarantine")
+	}
+
+	switch Config.ReplicationLog.FailurePolicy {
+	case HaltOnFailure, DeadLetterOnFailure:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidFailurePolicy, Config.ReplicationLog.FailurePolicy)
+	}
+
+	switch Config.ReplicationLog.Codec {
+	case "", NoCodec, ZstdCodec, S2Codec, ZstdDictCodec:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidPayloadCodec, Config.ReplicationLog.Codec)
+	}
+
+	// Consumer with fewer pending entries than a batch would never fill it
+	if Config.ReplicationLog.MaxAckPending < Config.ReplicationLog.ApplyBatchSize {
+		return fmt.Errorf(
+			"%w: %d < %d",
+			ErrInvalidMaxAckPending,
+			Config.ReplicationLog.MaxAckPending,
+			Config.ReplicationLog.ApplyBatchSize,
+		)
+	}
+
+	for _, trusted := range Config.Signing.Trusted {
+		for _, pattern := range trusted.Tables {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%w: %s", ErrInvalidTablePattern, pattern)
+			}
+		}
+	}
+
+	return Config.Tables.validate()
+}
+
+// PayloadCodec returns codec used for publishing, compress picks one when codec isn't set
+func (r *ReplicationLogConfiguration) PayloadCodec() PayloadCodec {
+	if r.Codec != "" {
+		return r.Codec
+	}
+
+	if r.Compress {
+		return ZstdCodec
+	}
+
+	return NoCodec
 }
 
 func (c *Configuration) SnapshotStorageType() SnapshotStoreType {
@@ -223,3 +396,98 @@ func (c *Configuration) SnapshotStorageType() SnapshotStoreType {
 func (c *Configuration) NodeName() string {
 	return fmt.Sprintf("%s-%d", NodeNamePrefix, c.NodeID)
 }
+
+// IsWatched returns true if table matches any include pattern (or no include patterns
+// are configured) and does not match any exclude pattern
+func (t *TablesConfiguration) IsWatched(tableName string) bool {
+	if len(t.Include) > 0 && !matchesAny(t.Include, tableName) {
+		return false
+	}
+
+	return !matchesAny(t.Exclude, tableName)
+}
+
+// Direction returns replication direction of first policy matching table, defaults to Both
+func (t *TablesConfiguration) Direction(tableName string) TableDirection {
+	for _, policy := range t.Policies {
+		if matchesAny([]string{policy.Pattern}, tableName) && policy.Direction != "" {
+			return policy.Direction
+		}
+	}
+
+	return Both
+}
+
+// ConflictResolver returns conflict resolver name of first policy matching table that sets one,
+// defaults to DefaultConflictResolver
+func (t *TablesConfiguration) ConflictResolver(tableName string) string {
+	for _, policy := range t.Policies {
+		if matchesAny([]string{policy.Pattern}, tableName) && policy.Conflict != "" {
+			return policy.Conflict
+		}
+	}
+
+	return DefaultConflictResolver
+}
+
+// ShardKey returns shard key column of first policy matching table that sets one, empty
+// if rows of table are sharded by primary key
+func (t *TablesConfiguration) ShardKey(tableName string) string {
+	for _, policy := range t.Policies {
+		if matchesAny([]string{policy.Pattern}, tableName) && policy.ShardKey != "" {
+			return policy.ShardKey
+		}
+	}
+
+	return ""
+}
+
+func (t *TablesConfiguration) CanPublish(tableName string) bool {
+	return t.IsWatched(tableName) && t.Direction(tableName) != ReplicateOnly
+}
+
+func (t *TablesConfiguration) CanReplicate(tableName string) bool {
+	return t.IsWatched(tableName) && t.Direction(tableName) != PublishOnly
+}
+
+func (t *TablesConfiguration) validate() error {
+	patterns := append(append([]string{}, t.Include...), t.Exclude...)
+	for _, policy := range t.Policies {
+		patterns = append(patterns, policy.Pattern)
+		switch policy.Direction {
+		case "", Both, PublishOnly, ReplicateOnly:
+		default:
+			return fmt.Errorf("%w: %s", ErrInvalidTableDirection, policy.Direction)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidTablePattern, pattern)
+		}
+	}
+
+	return nil
+}
+
+// CanPublish tells if node is allowed to publish changes of table, nodes without trusted entry
+// and entries without table patterns are not restricted
+func (s *SigningConfiguration) CanPublish(nodeID uint64, tableName string) bool {
+	for _, trusted := range s.Trusted {
+		if trusted.NodeID == nodeID {
+			return len(trusted.Tables) == 0 || matchesAny(trusted.Tables, tableName)
+		}
+	}
+
+	return true
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,40 @@
+package cfg
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadValidatesMaxAckPending(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr error
+	}{
+		{"defaults", "", nil},
+		{"pending above batch", "[replication_log]\napply_batch_size=64\nmax_ack_pending=128\n", nil},
+		{"pending equal to batch", "[replication_log]\napply_batch_size=64\nmax_ack_pending=64\n", nil},
+		{"pending below batch", "[replication_log]\napply_batch_size=64\nmax_ack_pending=16\n", ErrInvalidMaxAckPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := Config
+			copied := *saved
+			Config = &copied
+			t.Cleanup(func() { Config = saved })
+
+			configPath := path.Join(t.TempDir(), "config.toml")
+			err := os.WriteFile(configPath, []byte("db_path=\"/tmp/marmot.db\"\n"+tt.content), 0640)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = Load(configPath); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Load() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
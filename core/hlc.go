@@ -0,0 +1,47 @@
+package core
+
+import (
+	"time"
+)
+
+const hlcLogicalBits = 16
+
+// HLCTimestamp is a hybrid logical clock reading, Time packs physical milliseconds
+// in upper 48 bits and logical counter in lower 16 bits. NodeID breaks ties between
+// equal readings from different nodes. Local changes are stamped by change log triggers
+// from a clock persisted in database, which moves forward past every replicated reading.
+type HLCTimestamp struct {
+	Time   uint64
+	NodeID uint64
+}
+
+// HLCTime returns clock reading of physical time t with logical counter at zero
+func HLCTime(t time.Time) uint64 {
+	return uint64(t.UnixMilli()) << hlcLogicalBits
+}
+
+func (t HLCTimestamp) Compare(o HLCTimestamp) int {
+	if t.Time != o.Time {
+		if t.Time < o.Time {
+			return -1
+		}
+		return 1
+	}
+
+	if t.NodeID != o.NodeID {
+		if t.NodeID < o.NodeID {
+			return -1
+		}
+		return 1
+	}
+
+	return 0
+}
+
+func (t HLCTimestamp) IsZero() bool {
+	return t.Time == 0 && t.NodeID == 0
+}
+
+func (t HLCTimestamp) Physical() time.Time {
+	return time.UnixMilli(int64(t.Time >> hlcLogicalBits))
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLCTimestampCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a    HLCTimestamp
+		b    HLCTimestamp
+		want int
+	}{
+		{"equal", HLCTimestamp{Time: 10, NodeID: 1}, HLCTimestamp{Time: 10, NodeID: 1}, 0},
+		{"older time", HLCTimestamp{Time: 9, NodeID: 2}, HLCTimestamp{Time: 10, NodeID: 1}, -1},
+		{"newer time", HLCTimestamp{Time: 11, NodeID: 1}, HLCTimestamp{Time: 10, NodeID: 2}, 1},
+		{"lower node breaks tie", HLCTimestamp{Time: 10, NodeID: 1}, HLCTimestamp{Time: 10, NodeID: 2}, -1},
+		{"higher node breaks tie", HLCTimestamp{Time: 10, NodeID: 3}, HLCTimestamp{Time: 10, NodeID: 2}, 1},
+		{"logical counter orders same millisecond", HLCTimestamp{Time: 1<<hlcLogicalBits | 1}, HLCTimestamp{Time: 1 << hlcLogicalBits}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Compare(tt.b); got != tt.want {
+				t.Errorf("Compare() = %d, want %d", got, tt.want)
+			}
+
+			if got := tt.b.Compare(tt.a); got != -tt.want {
+				t.Errorf("reversed Compare() = %d, want %d", got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestHLCTimestampIsZero(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   HLCTimestamp
+		want bool
+	}{
+		{"zero", HLCTimestamp{}, true},
+		{"time only", HLCTimestamp{Time: 1}, false},
+		{"node only", HLCTimestamp{NodeID: 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ts.IsZero(); got != tt.want {
+				t.Errorf("IsZero() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHLCTimePhysicalRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		time    time.Time
+		logical uint64
+	}{
+		{"epoch", time.UnixMilli(0), 0},
+		{"now", time.UnixMilli(time.Now().UnixMilli()), 0},
+		{"logical counter ignored", time.UnixMilli(1760659200123), 42},
+		{"max logical counter", time.UnixMilli(1760659200123), 1<<hlcLogicalBits - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := HLCTimestamp{Time: HLCTime(tt.time) + tt.logical}
+			if got := ts.Physical(); !got.Equal(tt.time) {
+				t.Errorf("Physical() = %v, want %v", got, tt.time)
+			}
+		})
+	}
+}
+
+func TestHLCTimeTruncatesToMillisecond(t *testing.T) {
+	base := time.UnixMilli(1760659200123)
+	if HLCTime(base.Add(999*time.Microsecond)) != HLCTime(base) {
+		t.Error("HLCTime() differs within same millisecond")
+	}
+
+	if HLCTime(base.Add(time.Millisecond)) <= HLCTime(base) {
+		t.Error("HLCTime() doesn't increase with next millisecond")
+	}
+}
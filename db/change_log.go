@@ -6,12 +6,14 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
 	"github.com/maxpert/marmot/utils"
 
 	_ "embed"
@@ -44,29 +46,37 @@ const (
 	Failed    ChangeLogState = -1
 )
 const changeLogName = "change_log"
-const upsertQuery = `INSERT OR REPLACE INTO %s(%s) VALUES (%s)`
+const replaceQuery = `INSERT OR REPLACE INTO %s(%s) VALUES (%s)`
+
+// upsertQuery updates existing row in place, unlike REPLACE it never deletes a row so no
+// ON DELETE actions fire, but rows colliding on other unique keys fail instead of being replaced
+const upsertQuery = `INSERT INTO %s(%s) VALUES (%s) ON CONFLICT(%s) DO %s`
+const sealCommitGroupQuery = `UPDATE %[1]s SET value = value + 1
+WHERE id = 1 AND EXISTS (SELECT 1 FROM %[2]s WHERE commit_group >= %[1]s.value)`
 
 type globalChangeLogTemplateData struct {
 	Prefix string
 }
 
+// triggerTarget names row images trigger captures, New is recorded as row of change
+// and Old as its before-image, if any
+type triggerTarget struct {
+	New string
+	Old string
+}
+
 type triggerTemplateData struct {
 	Prefix    string
 	TableName string
 	Columns   []*ColumnInfo
-	Triggers  map[string]string
+	Triggers  map[string]triggerTarget
 }
 
 type globalChangeLogEntry struct {
 	Id            int64  `db:"id"`
 	ChangeTableId int64  `db:"change_table_id"`
 	TableName     string `db:"table_name"`
-}
-
-type changeLogEntry struct {
-	Id    int64  `db:"id"`
-	Type  string `db:"type"`
-	State string `db:"state"`
+	CommitGroup   int64  `db:"commit_group"`
 }
 
 func init() {
@@ -79,11 +89,35 @@ func init() {
 	)
 }
 
-func (conn *SqliteStreamDB) Replicate(event *ChangeLogEvent) error {
-	if err := conn.consumeReplicationEvent(event); err != nil {
-		return err
+func (conn *SqliteStreamDB) Replicate(tx *ChangeLogTransaction) error {
+	return conn.ReplicateBatch([]*ChangeLogTransaction{tx}, nil)
+}
+
+// ReplicateBatch applies transactions in given order within a single database transaction,
+// schema changes are applied on their own in between. Position if given is recorded within
+// last transaction, even if there is nothing left to apply.
+func (conn *SqliteStreamDB) ReplicateBatch(txs []*ChangeLogTransaction, position *StreamPosition) error {
+	sw := utils.NewStopWatch("replicate_batch")
+	defer sw.Log(log.Debug(), conn.stats.replicateLatency)
+
+	start := 0
+	for i, tx := range txs {
+		if !tx.IsSchemaChange() {
+			continue
+		}
+
+		if err := conn.consumeReplicationEvents(txs[start:i], nil); err != nil {
+			return err
+		}
+
+		if err := conn.applySchemaChanges(tx.Schema); err != nil {
+			return err
+		}
+
+		start = i + 1
 	}
-	return nil
+
+	return conn.consumeReplicationEvents(txs[start:], position)
 }
 
 func (conn *SqliteStreamDB) CleanupChangeLogs(beforeTime time.Time) (int64, error) {
@@ -94,7 +128,11 @@ func (conn *SqliteStreamDB) CleanupChangeLogs(beforeTime time.Time) (int64, erro
 	defer sqlConn.Return()
 
 	total := int64(0)
-	for name := range conn.watchTablesSchema {
+	for _, name := range conn.watchedTables() {
+		if !cfg.Config.Tables.CanPublish(name) {
+			continue
+		}
+
 		metaTableName := conn.metaTable(name, changeLogName)
 		rs, err := sqlConn.DB().Delete(metaTableName).
 			Where(
@@ -128,6 +166,10 @@ func (conn *SqliteStreamDB) globalMetaTable() string {
 	return conn.prefix + "_change_log_global"
 }
 
+func (conn *SqliteStreamDB) commitGroupTable() string {
+	return conn.prefix + "_commit_group"
+}
+
 func (conn *SqliteStreamDB) globalCDCScript() (string, error) {
 	buf := new(bytes.Buffer)
 	err := globalChangeLogTpl.Execute(buf, &globalChangeLogTemplateData{
@@ -142,15 +184,19 @@ func (conn *SqliteStreamDB) globalCDCScript() (string, error) {
 }
 
 func (conn *SqliteStreamDB) tableCDCScriptFor(tableName string) (string, error) {
-	columns, ok := conn.watchTablesSchema[tableName]
+	columns, ok := conn.tableSchema(tableName)
 	if !ok {
 		return "", errors.New("table info not found")
 	}
 
 	buf := new(bytes.Buffer)
 	err := tableChangeLogTpl.Execute(buf, &triggerTemplateData{
-		Prefix:    conn.prefix,
-		Triggers:  map[string]string{"insert": "NEW", "update": "NEW", "delete": "OLD"},
+		Prefix: conn.prefix,
+		Triggers: map[string]triggerTarget{
+			"insert": {New: "NEW"},
+			"update": {New: "NEW", Old: "OLD"},
+			"delete": {New: "OLD", Old: "OLD"},
+		},
 		Columns:   columns,
 		TableName: tableName,
 	})
@@ -162,36 +208,139 @@ func (conn *SqliteStreamDB) tableCDCScriptFor(tableName string) (string, error)
 	return spaceStripper.ReplaceAllString(buf.String(), "\n    "), nil
 }
 
-func (conn *SqliteStreamDB) consumeReplicationEvent(event *ChangeLogEvent) error {
+func (conn *SqliteStreamDB) consumeReplicationEvents(txs []*ChangeLogTransaction, position *StreamPosition) error {
+	if len(txs) == 0 && position == nil {
+		return nil
+	}
+
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
 	}
 	defer sqlConn.Return()
 
-	return sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
-		primaryKeyMap := conn.getPrimaryKeyMap(event)
-		if primaryKeyMap == nil {
-			return ErrNoTableMapping
+	err = sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
+		// Pragma resets on every commit, so it's set for each batch
+		if cfg.Config.ReplicationLog.DeferForeignKeys {
+			_, err := tnx.Exec("PRAGMA defer_foreign_keys = ON")
+			if err != nil {
+				return err
+			}
 		}
 
-		logEv := log.Debug().
-			Int64("event_id", event.Id).
-			Str("type", event.Type)
+		latest := core.HLCTimestamp{}
+		for _, tx := range txs {
+			for i := range tx.Events {
+				err := conn.replicateEvent(tnx, tx.CommitGroup, &tx.Events[i])
+				if err != nil {
+					return err
+				}
 
-		for k, v := range primaryKeyMap {
-			logEv = logEv.Str(event.TableName+"."+k, fmt.Sprintf("%v", v))
+				if tx.Events[i].Version.Compare(latest) > 0 {
+					latest = tx.Events[i].Version
+				}
+			}
 		}
 
-		logEv.Send()
+		err := conn.observeVersion(tnx, latest)
+		if err != nil {
+			return err
+		}
 
-		return replicateRow(tnx, event, primaryKeyMap)
+		if position != nil {
+			return conn.saveSequence(tnx, *position)
+		}
+
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	conn.stats.replicateBatchSize.Observe(float64(len(txs)))
+	return nil
+}
+
+func (conn *SqliteStreamDB) replicateEvent(tnx *goqu.TxDatabase, commitGroup int64, event *ChangeLogEvent) error {
+	primaryKeyMap := conn.getPrimaryKeyMap(event)
+	if primaryKeyMap == nil {
+		return ErrNoTableMapping
+	}
+
+	logEv := log.Debug().
+		Int64("commit_group", commitGroup).
+		Int64("event_id", event.Id).
+		Str("type", event.Type).
+		Uint64("version", event.Version.Time).
+		Uint64("version_node", event.Version.NodeID)
+
+	for k, v := range primaryKeyMap {
+		logEv = logEv.Str(event.TableName+"."+k, fmt.Sprintf("%v", v))
+	}
+
+	key, err := rowKey(primaryKeyMap)
+	if err != nil {
+		return err
+	}
+
+	stored, found, err := conn.getRowVersion(tnx, event.TableName, key)
+	if err != nil {
+		return err
+	}
+
+	if found && stored.isApplied(event.Version) {
+		conn.stats.staleSkipped.Inc()
+		logEv.Msg("Skipping stale event")
+		return nil
+	}
+
+	localVersion, pending, err := conn.localChange(tnx, event, primaryKeyMap, stored.Version)
+	if err != nil {
+		return err
+	}
+
+	// Own changes echoed back while row has local changes are part of local row already
+	if pending && event.Version.NodeID == cfg.Config.NodeID {
+		conn.stats.staleSkipped.Inc()
+		logEv.Msg("Skipping own event")
+		return nil
+	}
+
+	// Row was changed by a change origin node had not seen
+	if pending || (found && event.BaseVersion != stored.Version) {
+		// Own changes are part of local row, unless it's replayed onto a restored snapshot
+		// where change it was based upon is stored version
+		if event.Version.NodeID == cfg.Config.NodeID {
+			conn.stats.staleSkipped.Inc()
+			logEv.Msg("Skipping own event")
+			return nil
+		}
+
+		if !pending {
+			localVersion = stored.Version
+		}
+
+		local, err := conn.localConflictRow(tnx, event.TableName, primaryKeyMap, localVersion)
+		if err != nil {
+			return err
+		}
+
+		logEv.Msg("Resolving conflicting event")
+		return conn.resolveConflict(tnx, event, primaryKeyMap, key, local)
+	}
+
+	_, err = conn.recordRowVersion(tnx, event.TableName, key, event.Version, event.BaseVersion, event.Type == "delete")
+	if err != nil {
+		return err
+	}
+
+	logEv.Send()
+	return replicateRow(tnx, event, primaryKeyMap)
 }
 
 func (conn *SqliteStreamDB) getPrimaryKeyMap(event *ChangeLogEvent) map[string]any {
 	ret := make(map[string]any)
-	tableColsSchema, ok := conn.watchTablesSchema[event.TableName]
+	tableColsSchema, ok := conn.tableSchema(event.TableName)
 	if !ok {
 		return nil
 	}
@@ -223,10 +372,29 @@ func (conn *SqliteStreamDB) initGlobalChangeLog() error {
 		return err
 	}
 
-	return nil
+	// Change logs created by older versions don't have commit group and state columns
+	err = addMissingColumns(sqlConn.DB(), conn.globalMetaTable(), map[string]string{
+		"commit_group": "INTEGER DEFAULT 0",
+		"state":        "INTEGER DEFAULT 0",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = addMissingColumns(sqlConn.DB(), conn.rowVersionTable(), map[string]string{
+		"deleted": "INTEGER NOT NULL DEFAULT 0",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlConn.DB().Exec(fmt.Sprintf(tombstoneIndexQuery, conn.rowVersionTable()))
+	return err
 }
 
-func (conn *SqliteStreamDB) initTriggers(tableName string) error {
+// initTriggers creates change log and triggers of table, backfill logs rows table already has as
+// inserts along with triggers, for tables created while running that were written before
+func (conn *SqliteStreamDB) initTriggers(tableName string, backfill bool) error {
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
@@ -238,18 +406,97 @@ func (conn *SqliteStreamDB) initTriggers(tableName string) error {
 		return fmt.Errorf("invalid table to watch %s", tableName)
 	}
 
+	if !cfg.Config.Tables.CanPublish(name) {
+		log.Info().Str("table", name).Msg("Table is replicate only, skipping triggers")
+		return nil
+	}
+
 	script, err := conn.tableCDCScriptFor(name)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to prepare CDC statement")
 		return err
 	}
 
+	// Tables altered after change log was created need their new columns mirrored
+	columns, _ := conn.tableSchema(name)
+	err = addMissingColumns(sqlConn.DB(), conn.metaTable(name, changeLogName), changeLogColumns(columns))
+	if err != nil {
+		return err
+	}
+
 	log.Info().Msg(fmt.Sprintf("Creating trigger for %v", name))
-	_, err = sqlConn.DB().Exec(script)
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		_, err := tx.Exec(script)
+		if err != nil || !backfill {
+			return err
+		}
+
+		return conn.backfillChangeLog(tx, name, columns)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Backfilled rows are versioned same way as changes of older versions
+	return conn.stampLegacyChanges(sqlConn.DB(), conn.metaTable(name, changeLogName))
+}
+
+// backfillChangeLog logs every row of table as pending insert, triggers are installed within same
+// transaction so each row is either backfilled or captured by triggers
+func (conn *SqliteStreamDB) backfillChangeLog(tx *goqu.TxDatabase, tableName string, columns []*ColumnInfo) error {
+	changeLogTable := conn.metaTable(tableName, changeLogName)
+	lastID := int64(0)
+	_, err := tx.From(changeLogTable).
+		Select(goqu.COALESCE(goqu.MAX("id"), 0)).
+		ScanVal(&lastID)
+	if err != nil {
+		return err
+	}
+
+	cols := make([]any, 0, len(columns)+3)
+	vals := make([]any, 0, len(columns)+3)
+	for _, col := range columns {
+		cols = append(cols, "val_"+col.Name)
+		vals = append(vals, goqu.C(col.Name))
+	}
+
+	cols = append(cols, "type", "created_at", "state")
+	vals = append(vals, goqu.V("insert"), goqu.V(time.Now().UnixMilli()), goqu.V(Pending))
+	rs, err := tx.Insert(changeLogTable).
+		Cols(cols...).
+		FromQuery(goqu.From(tableName).Select(vals...)).
+		Prepared(true).
+		Executor().
+		Exec()
 	if err != nil {
 		return err
 	}
 
+	count, err := rs.RowsAffected()
+	if err != nil || count == 0 {
+		return err
+	}
+
+	_, err = tx.Insert(conn.globalMetaTable()).
+		Cols("change_table_id", "table_name", "commit_group").
+		FromQuery(
+			goqu.From(changeLogTable).
+				Select(
+					goqu.C("id"),
+					goqu.V(tableName),
+					goqu.From(conn.commitGroupTable()).Select("value").Where(goqu.C("id").Eq(1)),
+				).
+				Where(goqu.C("id").Gt(lastID)).
+				Order(goqu.C("id").Asc()),
+		).
+		Prepared(true).
+		Executor().
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("table", tableName).Int64("rows", count).Msg("Backfilled rows of new table into change log")
 	return nil
 }
 
@@ -328,7 +575,7 @@ func (conn *SqliteStreamDB) watchChanges(watcher *fsnotify.Watcher, path string)
 	}
 }
 
-func (conn *SqliteStreamDB) getGlobalChanges(limit uint32) ([]globalChangeLogEntry, error) {
+func (conn *SqliteStreamDB) getGlobalChanges(limit uint32, sealedGroup int64) ([]globalChangeLogEntry, error) {
 	sw := utils.NewStopWatch("scan_changes")
 	defer sw.Log(log.Debug(), conn.stats.scanChanges)
 
@@ -341,6 +588,10 @@ func (conn *SqliteStreamDB) getGlobalChanges(limit uint32) ([]globalChangeLogEnt
 	var entries []globalChangeLogEntry
 	err = sqlConn.DB().
 		From(conn.globalMetaTable()).
+		Where(
+			goqu.C("commit_group").Lte(sealedGroup),
+			goqu.C("state").Eq(Pending),
+		).
 		Order(goqu.I("id").Asc()).
 		Limit(uint(limit)).
 		ScanStructs(&entries)
@@ -348,7 +599,55 @@ func (conn *SqliteStreamDB) getGlobalChanges(limit uint32) ([]globalChangeLogEnt
 	if err != nil {
 		return nil, err
 	}
-	return entries, nil
+
+	if len(entries) < int(limit) || len(entries) == 0 {
+		return entries, nil
+	}
+
+	// Scan limit might have split last commit group, load rest of it so that it's published whole
+	last := entries[len(entries)-1]
+	var rest []globalChangeLogEntry
+	err = sqlConn.DB().
+		From(conn.globalMetaTable()).
+		Where(
+			goqu.C("commit_group").Eq(last.CommitGroup),
+			goqu.C("id").Gt(last.Id),
+			goqu.C("state").Eq(Pending),
+		).
+		Order(goqu.I("id").Asc()).
+		ScanStructs(&rest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(entries, rest...), nil
+}
+
+func (conn *SqliteStreamDB) sealCommitGroup() (int64, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	sealed := int64(0)
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		// Advancing commit group takes the write lock, so no application transaction can be
+		// in-flight and every change tagged with previous group is completely committed
+		_, err := tx.Exec(fmt.Sprintf(sealCommitGroupQuery, conn.commitGroupTable(), conn.globalMetaTable()))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.From(conn.commitGroupTable()).
+			Select(goqu.L("value - 1")).
+			Where(goqu.C("id").Eq(1)).
+			ScanVal(&sealed)
+		return err
+	})
+
+	return sealed, err
 }
 
 func (conn *SqliteStreamDB) countChanges() (int64, error) {
@@ -363,6 +662,7 @@ func (conn *SqliteStreamDB) countChanges() (int64, error) {
 
 	return sqlConn.DB().
 		From(conn.globalMetaTable()).
+		Where(goqu.C("state").Eq(Pending)).
 		Count()
 }
 
@@ -373,6 +673,20 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 	}
 	defer conn.publishLock.Unlock()
 
+	if time.Now().Before(conn.publishRetryAt) {
+		log.Debug().Time("retry_at", conn.publishRetryAt).Msg("Publish backing off...")
+		return
+	}
+
+	// Schema changes are published before any rows captured with new schema, so rows wait
+	// until they are
+	err := conn.publishSchemaChanges()
+	if err != nil {
+		conn.stats.publishFailures.Inc()
+		log.Error().Err(err).Msg("Unable to publish schema changes")
+		return
+	}
+
 	cnt, err := conn.countChanges()
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to count global changes")
@@ -385,165 +699,438 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 		return
 	}
 
-	changes, err := conn.getGlobalChanges(cfg.Config.ScanMaxChanges)
+	sealedGroup, err := conn.sealCommitGroup()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to seal commit group")
+		return
+	}
+
+	changes, err := conn.getGlobalChanges(cfg.Config.ScanMaxChanges, sealedGroup)
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to scan global changes")
 		return
 	}
 
-	if len(changes) < 0 {
+	txs, err := conn.loadChangeLogTransactions(changes)
+	if err != nil {
+		log.Error().Err(err).Msg("Error loading change log transactions")
 		return
 	}
 
-	for _, change := range changes {
-		logEntry := changeLogEntry{}
-		found := false
-		found, err = conn.getChangeEntry(&logEntry, change)
+	conn.publishTransactions(changes, txs)
+}
+
+// publishTransactions hands whole batch of transactions over for publishing and marks all of
+// their changes published in a single transaction once done
+func (conn *SqliteStreamDB) publishTransactions(changes []globalChangeLogEntry, txs []*ChangeLogTransaction) {
+	if conn.OnChange != nil {
+		sw := utils.NewStopWatch("publish_batch")
+		err := conn.OnChange(txs)
+		sw.Log(log.Debug(), conn.stats.publishLatency)
 
 		if err != nil {
-			log.Error().Err(err).Msg("Error scanning last row ID")
+			if errors.Is(err, ErrLogNotReadyToPublish) || errors.Is(err, context.Canceled) {
+				return
+			}
+
+			conn.stats.publishFailures.Inc()
+			log.Error().
+				Err(err).
+				Int("transactions", len(txs)).
+				Int("attempt", conn.publishAttempts).
+				Msg("Unable to consume changes")
+
+			if !conn.backoffPublish() {
+				conn.publishIsolated(changes, txs)
+			}
+
 			return
 		}
 
-		if !found {
-			log.Panic().
-				Str("table", change.TableName).
-				Int64("id", change.ChangeTableId).
-				Msg("Global change log row not found in corresponding table")
+		conn.publishAttempts = 0
+	}
+
+	conn.stats.publishBatchSize.Observe(float64(len(changes)))
+	err := conn.markChangesPublished(changes, txs)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to cleanup change log")
+	}
+
+	conn.stats.published.Add(float64(len(changes)))
+}
+
+// backoffPublish schedules retry of a failed publish with exponential backoff, it returns false
+// once publish_max_retries are exhausted
+func (conn *SqliteStreamDB) backoffPublish() bool {
+	conn.publishAttempts++
+	if conn.publishAttempts > cfg.Config.ReplicationLog.PublishMaxRetries {
+		conn.publishAttempts = 0
+		return false
+	}
+
+	maxBackoff := time.Duration(cfg.Config.ReplicationLog.PublishRetryMaxBackoff) * time.Millisecond
+	backoff := time.Duration(cfg.Config.ReplicationLog.PublishRetryBackoff) * time.Millisecond
+	for i := 1; i < conn.publishAttempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	conn.publishRetryAt = time.Now().Add(backoff)
+	time.AfterFunc(backoff, conn.publishChangeLog)
+	return true
+}
+
+// publishIsolated publishes transactions one at a time after retries were exhausted, so that
+// only transactions that keep failing are marked failed
+func (conn *SqliteStreamDB) publishIsolated(changes []globalChangeLogEntry, txs []*ChangeLogTransaction) {
+	groups := groupByCommit(changes)
+	for i, tx := range txs {
+		txChanges := groups[i]
+		err := conn.OnChange([]*ChangeLogTransaction{tx})
+		if errors.Is(err, ErrLogNotReadyToPublish) || errors.Is(err, context.Canceled) {
 			return
 		}
 
-		err = conn.consumeChangeLogs(change.TableName, []*changeLogEntry{&logEntry})
 		if err != nil {
-			if errors.Is(err, ErrLogNotReadyToPublish) || errors.Is(err, context.Canceled) {
-				break
+			log.Error().
+				Err(err).
+				Int64("commit_group", tx.CommitGroup).
+				Int("changes", len(txChanges)).
+				Msg("Marking changes failed")
+
+			err = conn.markChangesFailed(txChanges)
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to mark changes failed")
 			}
 
-			log.Error().Err(err).Msg("Unable to consume changes")
+			continue
 		}
 
-		err = conn.markChangePublished(change)
+		err = conn.markChangesPublished(txChanges, []*ChangeLogTransaction{tx})
 		if err != nil {
 			log.Error().Err(err).Msg("Unable to cleanup change log")
 		}
 
-		conn.stats.published.Inc()
+		conn.stats.published.Add(float64(len(txChanges)))
 	}
 }
 
-func (conn *SqliteStreamDB) markChangePublished(change globalChangeLogEntry) error {
+// markChangesFailed takes changes out of publishing, they are kept in change logs until requeued
+func (conn *SqliteStreamDB) markChangesFailed(changes []globalChangeLogEntry) error {
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
 	}
 	defer sqlConn.Return()
 
-	return sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
-		_, err = tx.Update(conn.metaTable(change.TableName, changeLogName)).
-			Set(goqu.Record{"state": Published}).
-			Where(goqu.Ex{"id": change.ChangeTableId}).
+	tableIds := make(map[string][]int64)
+	globalIds := make([]int64, 0, len(changes))
+	for _, change := range changes {
+		tableIds[change.TableName] = append(tableIds[change.TableName], change.ChangeTableId)
+		globalIds = append(globalIds, change.Id)
+	}
+
+	err = sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
+		for tableName, ids := range tableIds {
+			_, err := tnx.Update(conn.metaTable(tableName, changeLogName)).
+				Set(goqu.Record{"state": Failed}).
+				Where(goqu.C("id").In(ids)).
+				Prepared(true).
+				Executor().
+				Exec()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tnx.Update(conn.globalMetaTable()).
+			Set(goqu.Record{"state": Failed}).
+			Where(goqu.C("id").In(globalIds)).
 			Prepared(true).
 			Executor().
 			Exec()
 
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	conn.stats.failedChanges.Add(float64(len(changes)))
+	return nil
+}
+
+// RequeueFailedChanges puts changes that failed publishing back in line for publishing, in their
+// original transactions, returning number of requeued changes
+func (conn *SqliteStreamDB) RequeueFailedChanges() (int64, error) {
+	err := conn.initGlobalChangeLog()
+	if err != nil {
+		return 0, err
+	}
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	count := int64(0)
+	err = sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
+		var tableNames []string
+		err := tnx.From(conn.globalMetaTable()).
+			Select(goqu.DISTINCT("table_name")).
+			Where(goqu.C("state").Eq(Failed)).
+			Prepared(true).
+			ScanVals(&tableNames)
 		if err != nil {
 			return err
 		}
 
-		_, err = tx.Delete(conn.globalMetaTable()).
-			Where(goqu.C("id").Eq(change.Id)).
+		for _, tableName := range tableNames {
+			_, err = tnx.Update(conn.metaTable(tableName, changeLogName)).
+				Set(goqu.Record{"state": Pending}).
+				Where(goqu.C("state").Eq(Failed)).
+				Prepared(true).
+				Executor().
+				Exec()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		rs, err := tnx.Update(conn.globalMetaTable()).
+			Set(goqu.Record{"state": Pending}).
+			Where(goqu.C("state").Eq(Failed)).
 			Prepared(true).
 			Executor().
 			Exec()
-
 		if err != nil {
 			return err
 		}
 
-		return nil
+		count, err = rs.RowsAffected()
+		return err
 	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	conn.stats.failedChanges.Sub(float64(count))
+	return count, nil
 }
 
-func (conn *SqliteStreamDB) getChangeEntry(entry *changeLogEntry, change globalChangeLogEntry) (bool, error) {
+func (conn *SqliteStreamDB) countFailedChanges() (int64, error) {
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
-		return false, err
+		return -1, err
 	}
 	defer sqlConn.Return()
 
-	return sqlConn.DB().Select("id", "type", "state").
-		From(conn.metaTable(change.TableName, changeLogName)).
-		Where(
-			goqu.C("state").Eq(Pending),
-			goqu.C("id").Eq(change.ChangeTableId),
-		).
-		Prepared(true).
-		ScanStruct(entry)
+	return sqlConn.DB().
+		From(conn.globalMetaTable()).
+		Where(goqu.C("state").Eq(Failed)).
+		Count()
 }
 
-func (conn *SqliteStreamDB) consumeChangeLogs(tableName string, changes []*changeLogEntry) error {
-	rowIds := lo.Map(changes, func(e *changeLogEntry, i int) int64 {
-		return e.Id
+func (conn *SqliteStreamDB) markChangesPublished(changes []globalChangeLogEntry, txs []*ChangeLogTransaction) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	tableIds := make(map[string][]int64)
+	globalIds := make([]int64, 0, len(changes))
+	for _, change := range changes {
+		tableIds[change.TableName] = append(tableIds[change.TableName], change.ChangeTableId)
+		globalIds = append(globalIds, change.Id)
+	}
+
+	events := make([]*ChangeLogEvent, 0, len(changes))
+	for _, tx := range txs {
+		for i := range tx.Events {
+			events = append(events, &tx.Events[i])
+		}
+	}
+
+	err = sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
+		for _, event := range events {
+			key, err := rowKey(conn.getPrimaryKeyMap(event))
+			if err != nil {
+				return err
+			}
+
+			_, err = conn.recordRowVersion(tnx, event.TableName, key, event.Version, event.BaseVersion, event.Type == "delete")
+			if err != nil {
+				return err
+			}
+		}
+
+		for tableName, ids := range tableIds {
+			_, err = tnx.Update(conn.metaTable(tableName, changeLogName)).
+				Set(goqu.Record{"state": Published}).
+				Where(goqu.C("id").In(ids)).
+				Prepared(true).
+				Executor().
+				Exec()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tnx.Delete(conn.globalMetaTable()).
+			Where(goqu.C("id").In(globalIds)).
+			Prepared(true).
+			Executor().
+			Exec()
+
+		if err != nil {
+			return err
+		}
+
+		return nil
 	})
 
-	changeMap := lo.Associate(
-		changes,
-		func(l *changeLogEntry) (int64, *changeLogEntry) {
-			return l.Id, l
-		},
-	)
+	return err
+}
+
+// loadChangeLogTransactions loads change rows of all tables in bulk and groups them
+// into transactions by commit group
+func (conn *SqliteStreamDB) loadChangeLogTransactions(changes []globalChangeLogEntry) ([]*ChangeLogTransaction, error) {
+	tableIds := make(map[string][]int64)
+	for _, change := range changes {
+		tableIds[change.TableName] = append(tableIds[change.TableName], change.ChangeTableId)
+	}
 
+	tableEvents := make(map[string]map[int64]*ChangeLogEvent)
+	for tableName, ids := range tableIds {
+		events, err := conn.loadChangeEvents(tableName, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		tableEvents[tableName] = events
+	}
+
+	txs := make([]*ChangeLogTransaction, 0)
+	for _, group := range groupByCommit(changes) {
+		tx := &ChangeLogTransaction{
+			CommitGroup: group[0].CommitGroup,
+			Events:      make([]ChangeLogEvent, 0, len(group)),
+		}
+		txs = append(txs, tx)
+
+		for _, change := range group {
+			event, found := tableEvents[change.TableName][change.ChangeTableId]
+			if !found {
+				log.Panic().
+					Str("table", change.TableName).
+					Int64("id", change.ChangeTableId).
+					Msg("Global change log row not found in corresponding table")
+			}
+
+			tx.Events = append(tx.Events, *event)
+		}
+	}
+
+	return txs, nil
+}
+
+func (conn *SqliteStreamDB) loadChangeEvents(tableName string, ids []int64) (map[int64]*ChangeLogEvent, error) {
+	tableInfo, _ := conn.tableSchema(tableName)
 	idColumnName := conn.prefix + "change_log_id"
-	rawRows, err := conn.fetchChangeRows(tableName, idColumnName, rowIds)
+	typeColumnName := conn.prefix + "change_log_type"
+	oldColumnPrefix := conn.prefix + "old_"
+	versionColumnPrefix := conn.prefix + "version_"
+	rawRows, err := conn.fetchChangeRows(tableName, idColumnName, typeColumnName, oldColumnPrefix, versionColumnPrefix, ids)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rows := &EnhancedRows{rawRows}
 	defer rows.Finalize()
 
+	events := make(map[int64]*ChangeLogEvent)
+	ordered := make([]*ChangeLogEvent, 0, len(ids))
+	pinned := make(map[*ChangeLogEvent]bool)
 	for rows.Next() {
 		row, err := rows.fetchRow()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		changeRowID := row[idColumnName].(int64)
-		changeRow := changeMap[changeRowID]
+		changeType := row[typeColumnName].(string)
+		version, _ := row[versionColumnPrefix+"version"].(int64)
+		baseVersion, hasBase := row[versionColumnPrefix+"base_version"].(int64)
+		baseNodeID, _ := row[versionColumnPrefix+"base_node_id"].(int64)
 		delete(row, idColumnName)
+		delete(row, typeColumnName)
+		delete(row, versionColumnPrefix+"version")
+		delete(row, versionColumnPrefix+"base_version")
+		delete(row, versionColumnPrefix+"base_node_id")
+
+		var oldRow map[string]any
+		if changeType != "insert" {
+			oldRow = make(map[string]any, len(tableInfo))
+		}
 
-		logger := log.With().
-			Int64("rowid", changeRowID).
-			Str("table", tableName).
-			Str("type", changeRow.Type).
-			Logger()
-
-		if conn.OnChange != nil {
-			err = conn.OnChange(&ChangeLogEvent{
-				Id:        changeRowID,
-				Type:      changeRow.Type,
-				TableName: tableName,
-				Row:       row,
-				tableInfo: conn.watchTablesSchema[tableName],
-			})
+		for _, col := range tableInfo {
+			if oldRow != nil {
+				oldRow[col.Name] = row[oldColumnPrefix+col.Name]
+			}
 
-			if err != nil {
-				if err == ErrLogNotReadyToPublish || err == context.Canceled {
-					return err
-				}
+			delete(row, oldColumnPrefix+col.Name)
+		}
 
-				logger.Error().Err(err).Msg("Failed to publish for table " + tableName)
-				return err
-			}
+		event := &ChangeLogEvent{
+			Id:        changeRowID,
+			Type:      changeType,
+			TableName: tableName,
+			Row:       row,
+			OldRow:    oldRow,
+			Version:   core.HLCTimestamp{Time: uint64(version), NodeID: cfg.Config.NodeID},
+			tableInfo: tableInfo,
 		}
+
+		// Base is pinned once a replicated change was applied over pending change
+		if hasBase {
+			event.BaseVersion = core.HLCTimestamp{Time: uint64(baseVersion), NodeID: uint64(baseNodeID)}
+			pinned[event] = true
+		}
+
+		event.asDelta()
+		events[changeRowID] = event
+		ordered = append(ordered, event)
 	}
 
-	return nil
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.stampBaseVersions(ordered, pinned)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
 }
 
 func (conn *SqliteStreamDB) fetchChangeRows(
 	tableName string,
 	idColumnName string,
+	typeColumnName string,
+	oldColumnPrefix string,
+	versionColumnPrefix string,
 	rowIds []int64,
 ) (*sql.Rows, error) {
 	sqlConn, err := conn.pool.Borrow()
@@ -553,15 +1140,25 @@ func (conn *SqliteStreamDB) fetchChangeRows(
 	defer sqlConn.Return()
 
 	columnNames := make([]any, 0)
-	tableCols := conn.watchTablesSchema[tableName]
+	tableCols, _ := conn.tableSchema(tableName)
 	columnNames = append(columnNames, goqu.C("id").As(idColumnName))
+	columnNames = append(columnNames, goqu.C("type").As(typeColumnName))
+	for _, name := range []string{"version", "base_version", "base_node_id"} {
+		columnNames = append(columnNames, goqu.C(name).As(versionColumnPrefix+name))
+	}
+
 	for _, col := range tableCols {
 		columnNames = append(columnNames, goqu.C("val_"+col.Name).As(col.Name))
+		columnNames = append(columnNames, goqu.C("old_"+col.Name).As(oldColumnPrefix+col.Name))
 	}
 
 	query, params, err := sqlConn.DB().From(conn.metaTable(tableName, changeLogName)).
 		Select(columnNames...).
-		Where(goqu.C("id").In(rowIds)).
+		Where(
+			goqu.C("state").Eq(Pending),
+			goqu.C("id").In(rowIds),
+		).
+		Order(goqu.C("id").Asc()).
 		Prepared(true).
 		ToSQL()
 	if err != nil {
@@ -576,7 +1173,53 @@ func (conn *SqliteStreamDB) fetchChangeRows(
 	return rawRows, nil
 }
 
+func changeLogColumns(columns []*ColumnInfo) map[string]string {
+	ret := make(map[string]string, len(columns))
+	for _, col := range columns {
+		// Pending rows captured before column was added carry the column default,
+		// same as rows in the source table itself
+		definition := col.Type
+		if col.DefaultValue != nil {
+			definition = fmt.Sprintf("%s DEFAULT %v", col.Type, col.DefaultValue)
+		}
+
+		ret["val_"+col.Name] = definition
+		ret["old_"+col.Name] = col.Type
+	}
+
+	// Change logs created by older versions aren't versioned by triggers
+	ret["version"] = "INTEGER"
+	ret["base_version"] = "INTEGER"
+	ret["base_node_id"] = "INTEGER"
+	return ret
+}
+
+func groupByCommit(changes []globalChangeLogEntry) [][]globalChangeLogEntry {
+	groups := make([][]globalChangeLogEntry, 0)
+	for i, change := range changes {
+		if i == 0 || changes[i-1].CommitGroup != change.CommitGroup {
+			groups = append(groups, make([]globalChangeLogEntry, 0))
+		}
+
+		groups[len(groups)-1] = append(groups[len(groups)-1], change)
+	}
+
+	return groups
+}
+
 func replicateRow(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[string]any) error {
+	// Upsert on new key would leave row with old key behind
+	if oldPKMap, changed := primaryKeyChange(event, pkMap); changed {
+		err := replicateDelete(tx, event, oldPKMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	if event.Type == "update" && event.Delta {
+		return replicateUpdate(tx, event, pkMap)
+	}
+
 	if event.Type == "insert" || event.Type == "update" {
 		return replicateUpsert(tx, event, pkMap)
 	}
@@ -588,20 +1231,37 @@ func replicateRow(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[string]a
 	return fmt.Errorf("invalid operation type %s", event.Type)
 }
 
-func replicateUpsert(tx *goqu.TxDatabase, event *ChangeLogEvent, _ map[string]any) error {
+func replicateUpsert(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[string]any) error {
 	columnNames := make([]string, 0, len(event.Row))
 	columnValues := make([]any, 0, len(event.Row))
+	updates := make([]string, 0, len(event.Row))
 	for k, v := range event.Row {
 		columnNames = append(columnNames, k)
 		columnValues = append(columnValues, v)
+		if _, ok := pkMap[k]; !ok {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", k, k))
+		}
 	}
 
-	query := fmt.Sprintf(
-		upsertQuery,
-		event.TableName,
-		strings.Join(columnNames, ", "),
-		strings.Join(strings.Split(strings.Repeat("?", len(columnNames)), ""), ", "),
-	)
+	placeholders := strings.Join(strings.Split(strings.Repeat("?", len(columnNames)), ""), ", ")
+	query := fmt.Sprintf(replaceQuery, event.TableName, strings.Join(columnNames, ", "), placeholders)
+
+	// Replacing would delete referenced rows, firing their ON DELETE actions
+	if cfg.Config.ReplicationLog.DeferForeignKeys && len(pkMap) > 0 {
+		action := "NOTHING"
+		if len(updates) > 0 {
+			action = "UPDATE SET " + strings.Join(updates, ", ")
+		}
+
+		query = fmt.Sprintf(
+			upsertQuery,
+			event.TableName,
+			strings.Join(columnNames, ", "),
+			placeholders,
+			strings.Join(lo.Keys(pkMap), ", "),
+			action,
+		)
+	}
 
 	stmt, err := tx.Prepare(query)
 	if err != nil {
@@ -612,6 +1272,28 @@ func replicateUpsert(tx *goqu.TxDatabase, event *ChangeLogEvent, _ map[string]an
 	return err
 }
 
+func replicateUpdate(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[string]any) error {
+	record := goqu.Record{}
+	for k, v := range event.Row {
+		if _, isPK := pkMap[k]; !isPK {
+			record[k] = v
+		}
+	}
+
+	if len(record) == 0 {
+		return nil
+	}
+
+	_, err := tx.Update(event.TableName).
+		Set(record).
+		Where(goqu.Ex(pkMap)).
+		Prepared(true).
+		Executor().
+		Exec()
+
+	return err
+}
+
 func replicateDelete(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[string]any) error {
 	_, err := tx.Delete(event.TableName).
 		Where(goqu.Ex(pkMap)).
@@ -621,3 +1303,27 @@ func replicateDelete(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[strin
 
 	return err
 }
+
+// primaryKeyChange returns primary key of before-image if update changed primary key of row,
+// changes captured without before-image are never reported as key changes
+func primaryKeyChange(event *ChangeLogEvent, pkMap map[string]any) (map[string]any, bool) {
+	if event.Type != "update" || event.OldRow == nil {
+		return nil, false
+	}
+
+	oldPKMap := make(map[string]any, len(pkMap))
+	changed := false
+	for k, v := range pkMap {
+		old := event.OldRow[k]
+		if old == nil {
+			return nil, false
+		}
+
+		oldPKMap[k] = old
+		if !reflect.DeepEqual(old, v) {
+			changed = true
+		}
+	}
+
+	return oldPKMap, changed
+}
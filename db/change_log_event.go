@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"hash/fnv"
 	"reflect"
 	"sort"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
 	"github.com/maxpert/marmot/core"
 	"github.com/rs/zerolog/log"
 )
@@ -24,7 +26,24 @@ type ChangeLogEvent struct {
 	Type      string
 	TableName string
 	Row       map[string]any
-	tableInfo []*ColumnInfo `cbor:"-"`
+	// OldRow is before-image of updated or deleted row, nil for inserts
+	OldRow map[string]any
+	// Delta updates only carry changed and primary key columns in Row and OldRow
+	Delta   bool
+	Version core.HLCTimestamp
+	// BaseVersion is row version origin node had seen when change was made,
+	// rows with a different version on receiving node were changed concurrently
+	BaseVersion core.HLCTimestamp
+	tableInfo   []*ColumnInfo `cbor:"-"`
+}
+
+// ChangeLogTransaction groups all change log events captured within same commit group,
+// these events are published as single replication message and applied atomically.
+// Schema changes are published as transactions of their own without any events.
+type ChangeLogTransaction struct {
+	CommitGroup int64
+	Schema      []TableSchemaChange
+	Events      []ChangeLogEvent
 }
 
 func init() {
@@ -45,34 +64,117 @@ func (s sensitiveTypeWrapper) GetValue() any {
 	return s.Time
 }
 
+func (t ChangeLogTransaction) Wrap() (ChangeLogTransaction, error) {
+	ret := ChangeLogTransaction{
+		CommitGroup: t.CommitGroup,
+		Schema:      t.Schema,
+		Events:      make([]ChangeLogEvent, 0, len(t.Events)),
+	}
+
+	for _, e := range t.Events {
+		w, err := e.Wrap()
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Events = append(ret.Events, w)
+	}
+
+	return ret, nil
+}
+
+func (t ChangeLogTransaction) Unwrap() (ChangeLogTransaction, error) {
+	ret := ChangeLogTransaction{
+		CommitGroup: t.CommitGroup,
+		Schema:      t.Schema,
+		Events:      make([]ChangeLogEvent, 0, len(t.Events)),
+	}
+
+	for _, e := range t.Events {
+		u, err := e.Unwrap()
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Events = append(ret.Events, u)
+	}
+
+	return ret, nil
+}
+
+// Hash of a transaction is hash of its first event, whole transaction is routed to shard
+// of its first event so that it's applied atomically
+func (t ChangeLogTransaction) Hash() (uint64, error) {
+	if len(t.Events) == 0 {
+		return 0, nil
+	}
+
+	return t.Events[0].Hash()
+}
+
+// MessageID identifies transaction published by node for de-duplication, it's derived from
+// first change so republishing same changes after a crash yields same ID. Schema changes have
+// no ID since they are not tracked in change log.
+func (t ChangeLogTransaction) MessageID(nodeID uint64) string {
+	if len(t.Events) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d:%s:%d", nodeID, t.Events[0].TableName, t.Events[0].Id)
+}
+
 func (e ChangeLogEvent) Wrap() (ChangeLogEvent, error) {
 	return e.prepare(), nil
 }
 
 func (e ChangeLogEvent) Unwrap() (ChangeLogEvent, error) {
 	ret := ChangeLogEvent{
-		Id:        e.Id,
-		TableName: e.TableName,
-		Type:      e.Type,
-		Row:       map[string]any{},
-		tableInfo: e.tableInfo,
+		Id:          e.Id,
+		TableName:   e.TableName,
+		Type:        e.Type,
+		Row:         unwrapRow(e.Row),
+		OldRow:      unwrapRow(e.OldRow),
+		Delta:       e.Delta,
+		Version:     e.Version,
+		BaseVersion: e.BaseVersion,
+		tableInfo:   e.tableInfo,
 	}
 
-	for k, v := range e.Row {
+	return ret, nil
+}
+
+func unwrapRow(row map[string]any) map[string]any {
+	if row == nil {
+		return nil
+	}
+
+	ret := make(map[string]any, len(row))
+	for k, v := range row {
 		if st, ok := v.(sensitiveTypeWrapper); ok {
-			ret.Row[k] = st.GetValue()
+			ret[k] = st.GetValue()
 			continue
 		}
 
-		ret.Row[k] = v
+		ret[k] = v
 	}
 
-	return ret, nil
+	return ret
 }
 
+// Hash routes event by table and primary key, or by value of table's shard key column alone
+// when it's configured and set so that related rows of different tables share a shard
 func (e ChangeLogEvent) Hash() (uint64, error) {
 	hasher := fnv.New64()
 	enc := cbor.NewEncoder(hasher)
+	if shardKey := cfg.Config.Tables.ShardKey(e.TableName); shardKey != "" && e.Row[shardKey] != nil {
+		err := enc.Encode(e.Row[shardKey])
+		if err != nil {
+			return 0, err
+		}
+
+		return hasher.Sum64(), nil
+	}
+
 	err := enc.StartIndefiniteArray()
 	if err != nil {
 		return 0, err
@@ -99,6 +201,92 @@ func (e ChangeLogEvent) Hash() (uint64, error) {
 	return hasher.Sum64(), nil
 }
 
+// asDelta trims update down to changed and primary key columns, updates without
+// before-image or changing primary key are kept as full rows
+func (e *ChangeLogEvent) asDelta() {
+	if e.Type != "update" || e.OldRow == nil {
+		return
+	}
+
+	pkColumns := e.getSortedPKColumns()
+	isPK := make(map[string]bool, len(pkColumns))
+	for _, pk := range pkColumns {
+		if e.OldRow[pk] == nil || !reflect.DeepEqual(e.OldRow[pk], e.Row[pk]) {
+			return
+		}
+
+		isPK[pk] = true
+	}
+
+	// Shard key is kept so that delta is routed to same shard as full row
+	shardKey := cfg.Config.Tables.ShardKey(e.TableName)
+	row := make(map[string]any)
+	oldRow := make(map[string]any)
+	for k, v := range e.Row {
+		if isPK[k] || k == shardKey || !reflect.DeepEqual(v, e.OldRow[k]) {
+			row[k] = v
+			oldRow[k] = e.OldRow[k]
+		}
+	}
+
+	e.Row = row
+	e.OldRow = oldRow
+	e.Delta = true
+}
+
+func (t ChangeLogTransaction) IsSchemaChange() bool {
+	return len(t.Schema) > 0
+}
+
+func (t ChangeLogTransaction) IsEmpty() bool {
+	return len(t.Schema) == 0 && len(t.Events) == 0
+}
+
+// Tables returns distinct names of tables transaction changes
+func (t ChangeLogTransaction) Tables() []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0)
+	for _, s := range t.Schema {
+		if !seen[s.TableName] {
+			seen[s.TableName] = true
+			ret = append(ret, s.TableName)
+		}
+	}
+
+	for _, e := range t.Events {
+		if !seen[e.TableName] {
+			seen[e.TableName] = true
+			ret = append(ret, e.TableName)
+		}
+	}
+
+	return ret
+}
+
+// FilterTables returns copy of transaction retaining only schema changes and events
+// of tables accepted by allow
+func (t ChangeLogTransaction) FilterTables(allow func(tableName string) bool) ChangeLogTransaction {
+	ret := ChangeLogTransaction{
+		CommitGroup: t.CommitGroup,
+		Schema:      make([]TableSchemaChange, 0, len(t.Schema)),
+		Events:      make([]ChangeLogEvent, 0, len(t.Events)),
+	}
+
+	for _, s := range t.Schema {
+		if allow(s.TableName) {
+			ret.Schema = append(ret.Schema, s)
+		}
+	}
+
+	for _, e := range t.Events {
+		if allow(e.TableName) {
+			ret.Events = append(ret.Events, e)
+		}
+	}
+
+	return ret
+}
+
 func (e ChangeLogEvent) getSortedPKColumns() []string {
 	tablePKColumnsLock.RLock()
 
@@ -123,10 +311,41 @@ func (e ChangeLogEvent) getSortedPKColumns() []string {
 	return pkColumns
 }
 
+func forgetPKColumns(tableName string) {
+	tablePKColumnsLock.Lock()
+	defer tablePKColumnsLock.Unlock()
+
+	delete(tablePKColumnsCache, tableName)
+}
+
 func (e ChangeLogEvent) prepare() ChangeLogEvent {
+	preparedRow, rowTransformed := prepareRow(e.Row)
+	preparedOldRow, oldRowTransformed := prepareRow(e.OldRow)
+	if !rowTransformed && !oldRowTransformed {
+		return e
+	}
+
+	return ChangeLogEvent{
+		Id:          e.Id,
+		Type:        e.Type,
+		TableName:   e.TableName,
+		Row:         preparedRow,
+		OldRow:      preparedOldRow,
+		Delta:       e.Delta,
+		Version:     e.Version,
+		BaseVersion: e.BaseVersion,
+		tableInfo:   e.tableInfo,
+	}
+}
+
+func prepareRow(row map[string]any) (map[string]any, bool) {
+	if row == nil {
+		return nil, false
+	}
+
 	needsTransform := false
 	preparedRow := map[string]any{}
-	for k, v := range e.Row {
+	for k, v := range row {
 		if t, ok := v.(time.Time); ok {
 			preparedRow[k] = sensitiveTypeWrapper{Time: &t}
 			needsTransform = true
@@ -135,15 +354,5 @@ func (e ChangeLogEvent) prepare() ChangeLogEvent {
 		}
 	}
 
-	if !needsTransform {
-		return e
-	}
-
-	return ChangeLogEvent{
-		Id:        e.Id,
-		Type:      e.Type,
-		TableName: e.TableName,
-		Row:       preparedRow,
-		tableInfo: e.tableInfo,
-	}
+	return preparedRow, needsTransform
 }
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/samber/lo"
+)
+
+func testEvent(typ string, row map[string]any, oldRow map[string]any, pkColumns ...string) *ChangeLogEvent {
+	tableName := "items"
+	forgetPKColumns(tableName)
+	info := make([]*ColumnInfo, 0, len(row))
+	for k := range row {
+		info = append(info, &ColumnInfo{Name: k, IsPrimaryKey: lo.Contains(pkColumns, k)})
+	}
+
+	return &ChangeLogEvent{Type: typ, TableName: tableName, Row: row, OldRow: oldRow, tableInfo: info}
+}
+
+func TestChangeLogEventAsDelta(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      *ChangeLogEvent
+		shardKey   string
+		wantDelta  bool
+		wantRow    map[string]any
+		wantOldRow map[string]any
+	}{
+		{
+			name: "keeps changed and primary key columns",
+			event: testEvent("update",
+				map[string]any{"id": int64(1), "name": "b", "qty": int64(2)},
+				map[string]any{"id": int64(1), "name": "a", "qty": int64(2)},
+				"id"),
+			wantDelta:  true,
+			wantRow:    map[string]any{"id": int64(1), "name": "b"},
+			wantOldRow: map[string]any{"id": int64(1), "name": "a"},
+		},
+		{
+			name: "keeps shard key",
+			event: testEvent("update",
+				map[string]any{"id": int64(1), "name": "b", "tenant": int64(7)},
+				map[string]any{"id": int64(1), "name": "a", "tenant": int64(7)},
+				"id"),
+			shardKey:   "tenant",
+			wantDelta:  true,
+			wantRow:    map[string]any{"id": int64(1), "name": "b", "tenant": int64(7)},
+			wantOldRow: map[string]any{"id": int64(1), "name": "a", "tenant": int64(7)},
+		},
+		{
+			name: "changed to null",
+			event: testEvent("update",
+				map[string]any{"id": int64(1), "name": nil, "qty": int64(2)},
+				map[string]any{"id": int64(1), "name": "a", "qty": int64(2)},
+				"id"),
+			wantDelta:  true,
+			wantRow:    map[string]any{"id": int64(1), "name": nil},
+			wantOldRow: map[string]any{"id": int64(1), "name": "a"},
+		},
+		{
+			name: "primary key change stays full row",
+			event: testEvent("update",
+				map[string]any{"id": int64(2), "name": "a"},
+				map[string]any{"id": int64(1), "name": "a"},
+				"id"),
+			wantRow:    map[string]any{"id": int64(2), "name": "a"},
+			wantOldRow: map[string]any{"id": int64(1), "name": "a"},
+		},
+		{
+			name: "missing before-image stays full row",
+			event: testEvent("update",
+				map[string]any{"id": int64(1), "name": "a"},
+				nil,
+				"id"),
+			wantRow: map[string]any{"id": int64(1), "name": "a"},
+		},
+		{
+			name: "insert stays full row",
+			event: testEvent("insert",
+				map[string]any{"id": int64(1), "name": "a"},
+				nil,
+				"id"),
+			wantRow: map[string]any{"id": int64(1), "name": "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies := cfg.Config.Tables.Policies
+			t.Cleanup(func() { cfg.Config.Tables.Policies = policies })
+			if tt.shardKey != "" {
+				cfg.Config.Tables.Policies = []cfg.TablePolicyConfiguration{
+					{Pattern: tt.event.TableName, ShardKey: tt.shardKey},
+				}
+			}
+
+			tt.event.asDelta()
+			if tt.event.Delta != tt.wantDelta {
+				t.Errorf("Delta = %v, want %v", tt.event.Delta, tt.wantDelta)
+			}
+
+			if !reflect.DeepEqual(tt.event.Row, tt.wantRow) {
+				t.Errorf("Row = %v, want %v", tt.event.Row, tt.wantRow)
+			}
+
+			if !reflect.DeepEqual(tt.event.OldRow, tt.wantOldRow) {
+				t.Errorf("OldRow = %v, want %v", tt.event.OldRow, tt.wantOldRow)
+			}
+		})
+	}
+}
+
+func TestPrimaryKeyChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       *ChangeLogEvent
+		pkMap       map[string]any
+		wantOld     map[string]any
+		wantChanged bool
+	}{
+		{
+			name: "changed key",
+			event: &ChangeLogEvent{Type: "update",
+				OldRow: map[string]any{"id": int64(1), "name": "a"}},
+			pkMap:       map[string]any{"id": int64(2)},
+			wantOld:     map[string]any{"id": int64(1)},
+			wantChanged: true,
+		},
+		{
+			name: "one column of composite key changed",
+			event: &ChangeLogEvent{Type: "update",
+				OldRow: map[string]any{"a": int64(1), "b": "x"}},
+			pkMap:       map[string]any{"a": int64(1), "b": "y"},
+			wantOld:     map[string]any{"a": int64(1), "b": "x"},
+			wantChanged: true,
+		},
+		{
+			name: "same key",
+			event: &ChangeLogEvent{Type: "update",
+				OldRow: map[string]any{"id": int64(1), "name": "a"}},
+			pkMap:   map[string]any{"id": int64(1)},
+			wantOld: map[string]any{"id": int64(1)},
+		},
+		{
+			name: "before-image without key",
+			event: &ChangeLogEvent{Type: "update",
+				OldRow: map[string]any{"name": "a"}},
+			pkMap: map[string]any{"id": int64(1)},
+		},
+		{
+			name:  "update without before-image",
+			event: &ChangeLogEvent{Type: "update"},
+			pkMap: map[string]any{"id": int64(1)},
+		},
+		{
+			name: "delete",
+			event: &ChangeLogEvent{Type: "delete",
+				OldRow: map[string]any{"id": int64(1)}},
+			pkMap: map[string]any{"id": int64(2)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, changed := primaryKeyChange(tt.event, tt.pkMap)
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+
+			if !reflect.DeepEqual(old, tt.wantOld) {
+				t.Errorf("old key = %v, want %v", old, tt.wantOld)
+			}
+		})
+	}
+}
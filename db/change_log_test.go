@@ -0,0 +1,255 @@
+package db
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+)
+
+// remoteEvent makes change of another node at given version, based upon base version
+func remoteEvent(typ string, table string, version uint64, base uint64, row map[string]any) ChangeLogEvent {
+	const node = 1000
+	ev := ChangeLogEvent{Type: typ, TableName: table, Row: row, Version: core.HLCTimestamp{Time: version, NodeID: node}}
+	if base != 0 {
+		ev.BaseVersion = core.HLCTimestamp{Time: base, NodeID: node}
+	}
+
+	return ev
+}
+
+// queryRows returns rows of query as strings, in order query returns them
+func queryRows(t *testing.T, raw *sql.DB, query string) [][]string {
+	rows, err := raw.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := make([][]string, 0)
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]any, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			t.Fatal(err)
+		}
+
+		row := make([]string, len(cols))
+		for i, v := range values {
+			row[i] = v.String
+		}
+
+		ret = append(ret, row)
+	}
+
+	return ret
+}
+
+func assertRows(t *testing.T, raw *sql.DB, query string, want ...[]string) {
+	t.Helper()
+	got := queryRows(t, raw, query)
+	if len(want) == 0 {
+		want = [][]string{}
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", query, got, want)
+	}
+}
+
+func enableForeignKeys(t *testing.T) {
+	t.Cleanup(func() { cfg.Config.ReplicationLog.DeferForeignKeys = false })
+	cfg.Config.ReplicationLog.DeferForeignKeys = true
+}
+
+func TestReplicateUpsertReplacesUniqueCollision(t *testing.T) {
+	conn, raw := openTestDB(t, `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, name TEXT);
+		INSERT INTO users VALUES (1, 'a@example.com', 'a');
+	`)
+
+	err := conn.Replicate(&ChangeLogTransaction{CommitGroup: 1, Events: []ChangeLogEvent{
+		remoteEvent("insert", "users", 10, 0, map[string]any{"id": int64(2), "email": "a@example.com", "name": "b"}),
+	}})
+	if err != nil {
+		t.Fatalf("Replicate() error = %v", err)
+	}
+
+	assertRows(t, raw, "SELECT id, email, name FROM users", []string{"2", "a@example.com", "b"})
+}
+
+func TestReplicateUpsertWithForeignKeys(t *testing.T) {
+	enableForeignKeys(t)
+	conn, raw := openTestDB(t, `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, name TEXT);
+		CREATE TABLE orders (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id) ON DELETE CASCADE);
+		INSERT INTO users VALUES (1, 'a@example.com', 'a');
+		INSERT INTO orders VALUES (1, 1);
+	`)
+
+	// Updating referenced row in place keeps its children
+	err := conn.Replicate(&ChangeLogTransaction{CommitGroup: 1, Events: []ChangeLogEvent{
+		remoteEvent("update", "users", 10, 0, map[string]any{"id": int64(1), "email": "a@example.com", "name": "renamed"}),
+	}})
+	if err != nil {
+		t.Fatalf("Replicate() error = %v", err)
+	}
+
+	assertRows(t, raw, "SELECT id, name FROM users", []string{"1", "renamed"})
+	assertRows(t, raw, "SELECT id, user_id FROM orders", []string{"1", "1"})
+
+	// Row colliding on another unique key isn't replaced, batch fails as a whole
+	err = conn.Replicate(&ChangeLogTransaction{CommitGroup: 2, Events: []ChangeLogEvent{
+		remoteEvent("insert", "users", 20, 0, map[string]any{"id": int64(3), "email": "c@example.com", "name": "c"}),
+		remoteEvent("insert", "users", 21, 0, map[string]any{"id": int64(2), "email": "a@example.com", "name": "b"}),
+	}})
+	if err == nil {
+		t.Fatal("Replicate() of unique key collision didn't fail")
+	}
+
+	assertRows(t, raw, "SELECT id FROM users", []string{"1"})
+	assertRows(t, raw, "SELECT id FROM orders", []string{"1"})
+}
+
+func TestCaptureGroupsCommittedTransactions(t *testing.T) {
+	conn, raw := openTestDB(t, `
+		CREATE TABLE orders (id INTEGER PRIMARY KEY, total INTEGER);
+		CREATE TABLE items (id INTEGER PRIMARY KEY, order_id INTEGER, qty INTEGER);
+	`)
+
+	tx, err := raw.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range []string{
+		"INSERT INTO orders VALUES (1, 0)",
+		"INSERT INTO items VALUES (1, 1, 2)",
+		"UPDATE orders SET total = 2 WHERE id = 1",
+	} {
+		if _, err = tx.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Publisher seals group of committed changes before later commits
+	pendingTransactions(t, conn)
+	_, err = raw.Exec("INSERT INTO items VALUES (2, 1, 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([][]string, 0)
+	for _, tx := range pendingTransactions(t, conn) {
+		events := make([]string, 0, len(tx.Events))
+		for _, e := range tx.Events {
+			events = append(events, e.Type+" "+e.TableName)
+		}
+
+		got = append(got, events)
+	}
+
+	want := [][]string{
+		{"insert orders", "insert items", "update orders"},
+		{"insert items"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pending transactions = %v, want %v", got, want)
+	}
+}
+
+func TestReplicateBatchIsAtomic(t *testing.T) {
+	conn, raw := openTestDB(t, "CREATE TABLE orders (id INTEGER PRIMARY KEY, total INTEGER NOT NULL)")
+	err := conn.ReplicateBatch([]*ChangeLogTransaction{
+		{CommitGroup: 1, Events: []ChangeLogEvent{
+			remoteEvent("insert", "orders", 10, 0, map[string]any{"id": int64(1), "total": int64(1)}),
+		}},
+		{CommitGroup: 2, Events: []ChangeLogEvent{
+			remoteEvent("insert", "orders", 11, 0, map[string]any{"id": int64(2), "total": int64(2)}),
+			remoteEvent("insert", "orders", 12, 0, map[string]any{"id": int64(3), "total": nil}),
+		}},
+	}, nil)
+	if err == nil {
+		t.Fatal("ReplicateBatch() with failing event didn't fail")
+	}
+
+	assertRows(t, raw, "SELECT id FROM orders")
+	assertRows(t, raw, "SELECT COUNT(*) FROM "+conn.rowVersionTable(), []string{"0"})
+}
+
+func TestReplicateEventVersions(t *testing.T) {
+	conn, raw := openTestDB(t, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)")
+	row := func(name string) map[string]any {
+		return map[string]any{"id": int64(1), "name": name}
+	}
+
+	steps := []struct {
+		name          string
+		event         ChangeLogEvent
+		wantName      []string
+		wantConflicts string
+	}{
+		{"insert", remoteEvent("insert", "users", 10, 0, row("a")), []string{"a"}, "0"},
+		{"update based on stored version", remoteEvent("update", "users", 20, 10, row("b")), []string{"b"}, "0"},
+		{"replayed insert is stale", remoteEvent("insert", "users", 10, 0, row("a")), []string{"b"}, "0"},
+		{"replayed update is stale", remoteEvent("update", "users", 20, 10, row("b")), []string{"b"}, "0"},
+		{"older concurrent update loses", remoteEvent("update", "users", 15, 10, row("c")), []string{"b"}, "1"},
+		{"newer concurrent update wins", remoteEvent("update", "users", 30, 10, row("d")), []string{"d"}, "2"},
+		{"delete", remoteEvent("delete", "users", 40, 30, row("d")), nil, "2"},
+		{"insert made before delete stays deleted", remoteEvent("insert", "users", 35, 0, row("e")), nil, "3"},
+		{"insert after delete", remoteEvent("insert", "users", 50, 40, row("f")), []string{"f"}, "3"},
+	}
+
+	for i, step := range steps {
+		err := conn.Replicate(&ChangeLogTransaction{CommitGroup: int64(i), Events: []ChangeLogEvent{step.event}})
+		if err != nil {
+			t.Fatalf("%s: Replicate() error = %v", step.name, err)
+		}
+
+		want := make([][]string, 0)
+		if step.wantName != nil {
+			want = append(want, step.wantName)
+		}
+
+		if got := queryRows(t, raw, "SELECT name FROM users"); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: rows = %v, want %v", step.name, got, want)
+		}
+
+		conflicts := queryRows(t, raw, "SELECT COUNT(*) FROM "+conn.conflictsTable())
+		if conflicts[0][0] != step.wantConflicts {
+			t.Errorf("%s: %s conflicts logged, want %s", step.name, conflicts[0][0], step.wantConflicts)
+		}
+	}
+}
+
+func TestReplicatePrimaryKeyChange(t *testing.T) {
+	conn, raw := openTestDB(t, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)")
+	insert := remoteEvent("insert", "users", 10, 0, map[string]any{"id": int64(1), "name": "a"})
+	update := remoteEvent("update", "users", 20, 0, map[string]any{"id": int64(2), "name": "a"})
+	update.OldRow = map[string]any{"id": int64(1), "name": "a"}
+
+	err := conn.ReplicateBatch([]*ChangeLogTransaction{
+		{CommitGroup: 1, Events: []ChangeLogEvent{insert}},
+		{CommitGroup: 2, Events: []ChangeLogEvent{update}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("ReplicateBatch() error = %v", err)
+	}
+
+	assertRows(t, raw, "SELECT id, name FROM users", []string{"2", "a"})
+}
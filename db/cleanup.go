@@ -5,6 +5,7 @@ import (
 
 	"github.com/doug-martin/goqu/v9"
 	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
 )
 
 const deleteTriggerQuery = `DROP TRIGGER IF EXISTS %s`
@@ -34,7 +35,39 @@ func removeMarmotTriggers(conn *goqu.Database, prefix string) error {
 	return nil
 }
 
-func removeMarmotTables(conn *goqu.Database, prefix string) error {
+func removeStaleTriggers(conn *goqu.Database, prefix string, keep func(tableName string) bool) error {
+	var triggers []struct {
+		Name      string `db:"name"`
+		TableName string `db:"tbl_name"`
+	}
+
+	err := conn.
+		Select("name", "tbl_name").
+		From("sqlite_master").
+		Where(goqu.C("type").Eq("trigger"), goqu.C("name").Like(prefix+"%")).
+		Prepared(true).
+		ScanStructs(&triggers)
+	if err != nil {
+		return err
+	}
+
+	for _, trigger := range triggers {
+		if keep(trigger.TableName) {
+			continue
+		}
+
+		log.Info().Str("name", trigger.Name).Str("table", trigger.TableName).Msg("Removing trigger of unpublished table")
+		_, err = conn.Exec(fmt.Sprintf(deleteTriggerQuery, trigger.Name))
+		if err != nil {
+			log.Error().Err(err).Str("name", trigger.Name).Msg("Unable to delete trigger")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeMarmotTables(conn *goqu.Database, prefix string, keep ...string) error {
 	tables := make([]string, 0)
 	err := conn.
 		Select("name").
@@ -47,6 +80,10 @@ func removeMarmotTables(conn *goqu.Database, prefix string) error {
 	}
 
 	for _, name := range tables {
+		if lo.Contains(keep, name) {
+			continue
+		}
+
 		query := fmt.Sprintf(deleteMarmotTables, name)
 		_, err = conn.Exec(query)
 		if err != nil {
@@ -0,0 +1,305 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+	"github.com/rs/zerolog/log"
+)
+
+const conflictsName = "conflicts"
+
+var ErrUnknownConflictResolver = errors.New("unknown conflict resolver")
+
+// ConflictRow is one side of a conflict, Row holds all columns of row, for deletes
+// only primary key columns are guaranteed to be present
+type ConflictRow struct {
+	Type    string
+	Row     map[string]any
+	Version core.HLCTimestamp
+}
+
+// ConflictResolver picks row to keep when same row was changed concurrently on two nodes.
+// It may return local, remote or a merged row. Every node resolves same conflict with
+// local and remote swapped, so result must only depend on versions and contents of rows.
+type ConflictResolver interface {
+	Resolve(tableName string, local, remote *ConflictRow) (*ConflictRow, error)
+}
+
+type ConflictResolverFunc func(tableName string, local, remote *ConflictRow) (*ConflictRow, error)
+
+func (f ConflictResolverFunc) Resolve(tableName string, local, remote *ConflictRow) (*ConflictRow, error) {
+	return f(tableName, local, remote)
+}
+
+var conflictResolversLock = &sync.RWMutex{}
+var conflictResolvers = map[string]ConflictResolver{
+	"lww":           ConflictResolverFunc(lastWriterWins),
+	"fww":           ConflictResolverFunc(firstWriterWins),
+	"keep-non-null": ConflictResolverFunc(keepNonNull),
+}
+
+// RegisterConflictResolver makes resolver available to table policies under given name,
+// it must be called before database is opened
+func RegisterConflictResolver(name string, resolver ConflictResolver) {
+	conflictResolversLock.Lock()
+	defer conflictResolversLock.Unlock()
+
+	conflictResolvers[name] = resolver
+}
+
+func getConflictResolver(name string) (ConflictResolver, error) {
+	conflictResolversLock.RLock()
+	defer conflictResolversLock.RUnlock()
+
+	resolver, ok := conflictResolvers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownConflictResolver, name)
+	}
+
+	return resolver, nil
+}
+
+func validateConflictResolvers() error {
+	for _, policy := range cfg.Config.Tables.Policies {
+		if policy.Conflict == "" {
+			continue
+		}
+
+		if _, err := getConflictResolver(policy.Conflict); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func lastWriterWins(_ string, local, remote *ConflictRow) (*ConflictRow, error) {
+	if remote.Version.Compare(local.Version) > 0 {
+		return remote, nil
+	}
+
+	return local, nil
+}
+
+func firstWriterWins(_ string, local, remote *ConflictRow) (*ConflictRow, error) {
+	if remote.Version.Compare(local.Version) < 0 {
+		return remote, nil
+	}
+
+	return local, nil
+}
+
+// keepNonNull takes newer row, but keeps column values of older row where newer one is null,
+// deletes are resolved as last writer wins
+func keepNonNull(tableName string, local, remote *ConflictRow) (*ConflictRow, error) {
+	newer, older := local, remote
+	if remote.Version.Compare(local.Version) > 0 {
+		newer, older = remote, local
+	}
+
+	if newer.Type == "delete" || older.Type == "delete" {
+		return lastWriterWins(tableName, local, remote)
+	}
+
+	merged := &ConflictRow{
+		Type:    newer.Type,
+		Row:     make(map[string]any, len(newer.Row)),
+		Version: newer.Version,
+	}
+
+	changed := false
+	for k, v := range newer.Row {
+		merged.Row[k] = v
+		if v == nil && older.Row[k] != nil {
+			merged.Row[k] = older.Row[k]
+			changed = true
+		}
+	}
+
+	if !changed {
+		return newer, nil
+	}
+
+	return merged, nil
+}
+
+func (conn *SqliteStreamDB) conflictsTable() string {
+	return conn.prefix + conflictsName
+}
+
+// localConflictRow reads current state of row from table, missing rows are reported as deleted
+func (conn *SqliteStreamDB) localConflictRow(
+	tx *goqu.TxDatabase,
+	tableName string,
+	pkMap map[string]any,
+	version core.HLCTimestamp,
+) (*ConflictRow, error) {
+	query, params, err := tx.From(tableName).
+		Where(goqu.Ex(pkMap)).
+		Prepared(true).
+		ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rawRows, err := tx.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &EnhancedRows{rawRows}
+	defer rows.Finalize()
+
+	if !rows.Next() {
+		return &ConflictRow{Type: "delete", Row: pkMap, Version: version}, rows.Err()
+	}
+
+	row, err := rows.fetchRow()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConflictRow{Type: "update", Row: row, Version: version}, nil
+}
+
+// resolveConflict runs resolver configured for table against replicated event, applies resolved
+// row unless local row was kept, and records conflict for audit. Both changes are recorded as
+// applied to row.
+func (conn *SqliteStreamDB) resolveConflict(
+	tx *goqu.TxDatabase,
+	event *ChangeLogEvent,
+	pkMap map[string]any,
+	key []byte,
+	local *ConflictRow,
+) error {
+	tableName := event.TableName
+	name := cfg.Config.Tables.ConflictResolver(tableName)
+	resolver, err := getConflictResolver(name)
+	if err != nil {
+		return err
+	}
+
+	// Row moved away from old key regardless of which change wins on new key
+	if oldPKMap, changed := primaryKeyChange(event, pkMap); changed {
+		err = replicateDelete(tx, event, oldPKMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Resolvers always see complete rows, delta is applied over local row unless it's gone
+	remote := &ConflictRow{Type: event.Type, Row: event.Row, Version: event.Version}
+	if event.Delta && local.Type != "delete" {
+		remote.Row = make(map[string]any, len(local.Row))
+		for k, v := range local.Row {
+			remote.Row[k] = v
+		}
+
+		for k, v := range event.Row {
+			remote.Row[k] = v
+		}
+	}
+
+	result, err := resolver.Resolve(tableName, local, remote)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().
+		Str("table", tableName).
+		Str("resolver", name).
+		Uint64("local_node", local.Version.NodeID).
+		Uint64("remote_node", remote.Version.NodeID).
+		Uint64("winner_node", result.Version.NodeID).
+		Msg("Resolved conflicting change")
+
+	err = conn.logConflict(tx, tableName, name, key, local, remote, result)
+	if err != nil {
+		return err
+	}
+
+	conn.stats.conflicts.Inc()
+	newer, older := local.Version, remote.Version
+	if newer.Compare(older) < 0 {
+		newer, older = older, newer
+	}
+
+	_, err = conn.recordRowVersion(tx, tableName, key, newer, older, result.Type == "delete")
+	if err != nil {
+		return err
+	}
+
+	if result == local {
+		return nil
+	}
+
+	if event.Delta && local.Type == "delete" && result.Type != "delete" {
+		log.Warn().
+			Str("table", tableName).
+			Uint64("remote_node", remote.Version.NodeID).
+			Msg("Restoring deleted row from partial change, columns it doesn't carry take their defaults")
+	}
+
+	// Resolved row is always written whole, an update of deleted row would change nothing
+	return replicateRow(tx, &ChangeLogEvent{
+		Type:      result.Type,
+		TableName: tableName,
+		Row:       result.Row,
+	}, pkMap)
+}
+
+func (conn *SqliteStreamDB) logConflict(
+	tx *goqu.TxDatabase,
+	tableName string,
+	resolver string,
+	key []byte,
+	local *ConflictRow,
+	remote *ConflictRow,
+	result *ConflictRow,
+) error {
+	localRow, err := json.Marshal(local.Row)
+	if err != nil {
+		return err
+	}
+
+	remoteRow, err := json.Marshal(remote.Row)
+	if err != nil {
+		return err
+	}
+
+	resultRow, err := json.Marshal(result.Row)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Insert(conn.conflictsTable()).
+		Rows(goqu.Record{
+			"table_name":     tableName,
+			"row_key":        key,
+			"resolver":       resolver,
+			"local_type":     local.Type,
+			"local_row":      string(localRow),
+			"local_version":  int64(local.Version.Time),
+			"local_node":     int64(local.Version.NodeID),
+			"remote_type":    remote.Type,
+			"remote_row":     string(remoteRow),
+			"remote_version": int64(remote.Version.Time),
+			"remote_node":    int64(remote.Version.NodeID),
+			"result_type":    result.Type,
+			"result_row":     string(resultRow),
+			"winner_node":    int64(result.Version.NodeID),
+			"resolved_at":    time.Now().UnixMilli(),
+		}).
+		Prepared(true).
+		Executor().
+		Exec()
+
+	return err
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/maxpert/marmot/core"
+)
+
+func conflictRow(typ string, time uint64, node uint64, row map[string]any) *ConflictRow {
+	return &ConflictRow{Type: typ, Row: row, Version: core.HLCTimestamp{Time: time, NodeID: node}}
+}
+
+func TestLastAndFirstWriterWins(t *testing.T) {
+	tests := []struct {
+		name      string
+		local     *ConflictRow
+		remote    *ConflictRow
+		wantNewer string
+	}{
+		{
+			name:      "remote newer",
+			local:     conflictRow("update", 10, 1, map[string]any{"id": 1}),
+			remote:    conflictRow("update", 20, 2, map[string]any{"id": 1}),
+			wantNewer: "remote",
+		},
+		{
+			name:      "local newer",
+			local:     conflictRow("update", 30, 1, map[string]any{"id": 1}),
+			remote:    conflictRow("delete", 20, 2, map[string]any{"id": 1}),
+			wantNewer: "local",
+		},
+		{
+			name:      "same time higher node is newer",
+			local:     conflictRow("update", 10, 1, map[string]any{"id": 1}),
+			remote:    conflictRow("update", 10, 2, map[string]any{"id": 1}),
+			wantNewer: "remote",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newer, older := tt.local, tt.remote
+			if tt.wantNewer == "remote" {
+				newer, older = tt.remote, tt.local
+			}
+
+			if got, _ := lastWriterWins("t", tt.local, tt.remote); got != newer {
+				t.Errorf("lastWriterWins() = %+v, want %+v", got, newer)
+			}
+
+			if got, _ := firstWriterWins("t", tt.local, tt.remote); got != older {
+				t.Errorf("firstWriterWins() = %+v, want %+v", got, older)
+			}
+
+			// Other node sees same conflict with sides swapped and has to pick same row
+			if got, _ := lastWriterWins("t", tt.remote, tt.local); got != newer {
+				t.Errorf("swapped lastWriterWins() = %+v, want %+v", got, newer)
+			}
+
+			if got, _ := firstWriterWins("t", tt.remote, tt.local); got != older {
+				t.Errorf("swapped firstWriterWins() = %+v, want %+v", got, older)
+			}
+		})
+	}
+}
+
+func TestKeepNonNull(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  *ConflictRow
+		remote *ConflictRow
+		want   *ConflictRow
+	}{
+		{
+			name:   "fills nulls of newer row from older",
+			local:  conflictRow("update", 10, 1, map[string]any{"id": 1, "a": "old", "b": "old"}),
+			remote: conflictRow("update", 20, 2, map[string]any{"id": 1, "a": nil, "b": "new"}),
+			want:   conflictRow("update", 20, 2, map[string]any{"id": 1, "a": "old", "b": "new"}),
+		},
+		{
+			name:   "keeps null when older is null too",
+			local:  conflictRow("update", 30, 1, map[string]any{"id": 1, "a": nil}),
+			remote: conflictRow("insert", 20, 2, map[string]any{"id": 1, "a": nil}),
+			want:   conflictRow("update", 30, 1, map[string]any{"id": 1, "a": nil}),
+		},
+		{
+			name:   "newer delete wins",
+			local:  conflictRow("update", 10, 1, map[string]any{"id": 1, "a": "old"}),
+			remote: conflictRow("delete", 20, 2, map[string]any{"id": 1}),
+			want:   conflictRow("delete", 20, 2, map[string]any{"id": 1}),
+		},
+		{
+			name:   "newer update wins over delete as is",
+			local:  conflictRow("delete", 10, 1, map[string]any{"id": 1}),
+			remote: conflictRow("update", 20, 2, map[string]any{"id": 1, "a": nil}),
+			want:   conflictRow("update", 20, 2, map[string]any{"id": 1, "a": nil}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, swapped := range []bool{false, true} {
+				local, remote := tt.local, tt.remote
+				if swapped {
+					local, remote = remote, local
+				}
+
+				got, err := keepNonNull("t", local, remote)
+				if err != nil {
+					t.Fatalf("keepNonNull() error = %v", err)
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("keepNonNull(swapped=%v) = %+v, want %+v", swapped, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetConflictResolver(t *testing.T) {
+	for _, name := range []string{"lww", "fww", "keep-non-null"} {
+		if _, err := getConflictResolver(name); err != nil {
+			t.Errorf("getConflictResolver(%q) error = %v", name, err)
+		}
+	}
+
+	if _, err := getConflictResolver("missing"); !errors.Is(err, ErrUnknownConflictResolver) {
+		t.Errorf("getConflictResolver() of unknown resolver error = %v, want %v", err, ErrUnknownConflictResolver)
+	}
+}
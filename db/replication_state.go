@@ -0,0 +1,125 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+const replicationStateName = "replication_state"
+const createReplicationStateTable = `CREATE TABLE IF NOT EXISTS %s (
+    stream TEXT PRIMARY KEY,
+    seq    INTEGER NOT NULL
+);`
+
+// StreamPosition is sequence of last replication log entry in a batch, it's recorded in same
+// transaction as changes it carries so that applied changes and position never diverge
+type StreamPosition struct {
+	Stream string
+	Seq    uint64
+}
+
+type sequenceWriter interface {
+	Insert(table interface{}) *goqu.InsertDataset
+}
+
+func (conn *SqliteStreamDB) replicationStateTable() string {
+	return conn.prefix + replicationStateName
+}
+
+// LoadSequences returns last applied sequence of every stream, state table is created if missing
+func (conn *SqliteStreamDB) LoadSequences() (map[string]uint64, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlConn.Return()
+
+	return loadSequences(sqlConn.DB(), conn.replicationStateTable())
+}
+
+// RestoreSequences replaces recorded sequences of all streams with seq
+func (conn *SqliteStreamDB) RestoreSequences(seq map[string]uint64) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	table := conn.replicationStateTable()
+	_, err = sqlConn.DB().Exec(fmt.Sprintf(createReplicationStateTable, table))
+	if err != nil {
+		return err
+	}
+
+	return sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		_, err := tx.Delete(table).Executor().Exec()
+		if err != nil {
+			return err
+		}
+
+		for stream, s := range seq {
+			err = conn.saveSequence(tx, StreamPosition{Stream: stream, Seq: s})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func loadSequences(gSQL *goqu.Database, table string) (map[string]uint64, error) {
+	_, err := gSQL.Exec(fmt.Sprintf(createReplicationStateTable, table))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Stream string `db:"stream"`
+		Seq    int64  `db:"seq"`
+	}
+
+	err = gSQL.From(table).
+		Select("stream", "seq").
+		Prepared(true).
+		ScanStructs(&entries)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]uint64, len(entries))
+	for _, e := range entries {
+		ret[e.Stream] = uint64(e.Seq)
+	}
+
+	return ret, nil
+}
+
+// SaveSequence records seq as last applied sequence of stream, unless a later one is already recorded
+func (conn *SqliteStreamDB) SaveSequence(stream string, seq uint64) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	return conn.saveSequence(sqlConn.DB(), StreamPosition{Stream: stream, Seq: seq})
+}
+
+func (conn *SqliteStreamDB) saveSequence(tx sequenceWriter, position StreamPosition) error {
+	table := conn.replicationStateTable()
+	_, err := tx.Insert(table).
+		Rows(goqu.Record{
+			"stream": position.Stream,
+			"seq":    int64(position.Seq),
+		}).
+		OnConflict(goqu.DoUpdate("stream", goqu.Record{
+			"seq": goqu.I("excluded.seq"),
+		}).Where(goqu.I("excluded.seq").Gt(goqu.I(table + ".seq")))).
+		Prepared(true).
+		Executor().
+		Exec()
+
+	return err
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplicateBatchSavesSequence(t *testing.T) {
+	conn, raw := openTestDB(t, "CREATE TABLE orders (id INTEGER PRIMARY KEY, total INTEGER NOT NULL)")
+	if _, err := conn.LoadSequences(); err != nil {
+		t.Fatalf("LoadSequences() error = %v", err)
+	}
+
+	insert := func(version uint64, id int64, total any) *ChangeLogTransaction {
+		return &ChangeLogTransaction{CommitGroup: int64(version), Events: []ChangeLogEvent{
+			remoteEvent("insert", "orders", version, 0, map[string]any{"id": id, "total": total}),
+		}}
+	}
+
+	steps := []struct {
+		name    string
+		txs     []*ChangeLogTransaction
+		seq     uint64
+		wantErr bool
+		want    map[string]uint64
+	}{
+		{"applied batch", []*ChangeLogTransaction{insert(10, 1, int64(1)), insert(11, 2, int64(2))}, 5, false, map[string]uint64{"s-1": 5}},
+		{"failed batch keeps sequence", []*ChangeLogTransaction{insert(12, 3, int64(3)), insert(13, 4, nil)}, 7, true, map[string]uint64{"s-1": 5}},
+		{"skipped entries move sequence", nil, 8, false, map[string]uint64{"s-1": 8}},
+		{"redelivered batch doesn't move sequence back", []*ChangeLogTransaction{insert(10, 1, int64(1))}, 5, false, map[string]uint64{"s-1": 8}},
+	}
+
+	for _, step := range steps {
+		err := conn.ReplicateBatch(step.txs, &StreamPosition{Stream: "s-1", Seq: step.seq})
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: ReplicateBatch() error = %v, want error %v", step.name, err, step.wantErr)
+		}
+
+		got, err := conn.LoadSequences()
+		if err != nil {
+			t.Fatalf("LoadSequences() error = %v", err)
+		}
+
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: sequences = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	assertRows(t, raw, "SELECT id FROM orders", []string{"1"}, []string{"2"})
+}
+
+func TestRestoreSequences(t *testing.T) {
+	conn, _ := openTestDB(t, "CREATE TABLE orders (id INTEGER PRIMARY KEY)")
+	_, err := conn.LoadSequences()
+	if err == nil {
+		err = conn.SaveSequence("s-1", 10)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored snapshot may be behind recorded sequences, they're replaced not merged
+	err = conn.RestoreSequences(map[string]uint64{"s-1": 3, "s-2": 4})
+	if err != nil {
+		t.Fatalf("RestoreSequences() error = %v", err)
+	}
+
+	got, err := conn.LoadSequences()
+	if err != nil {
+		t.Fatalf("LoadSequences() error = %v", err)
+	}
+
+	if want := map[string]uint64{"s-1": 3, "s-2": 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sequences = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,316 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+)
+
+const rowVersionName = "_row_version"
+const clockName = "_clock"
+const tombstoneIndexQuery = `CREATE INDEX IF NOT EXISTS %[1]s_tombstone_index ON %[1]s (version) WHERE deleted = 1`
+
+// stampLegacyChangesQuery versions pending changes captured by triggers of older versions in
+// order they were made, starting right after given clock reading
+const stampLegacyChangesQuery = `UPDATE %[1]s SET version = ? + id - (
+    SELECT MIN(id) FROM %[1]s WHERE state = 0 AND version IS NULL
+) WHERE state = 0 AND version IS NULL`
+
+// Row keys must encode same on every node
+var rowKeyEncMode = func() cbor.EncMode {
+	em, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	return em
+}()
+
+type rowVersionEntry struct {
+	Version     int64 `db:"version"`
+	NodeID      int64 `db:"node_id"`
+	BaseVersion int64 `db:"base_version"`
+	BaseNodeID  int64 `db:"base_node_id"`
+}
+
+// rowVersion is version of last change applied to row, every change versioned at or before
+// Base has been incorporated into row already
+type rowVersion struct {
+	Version core.HLCTimestamp
+	Base    core.HLCTimestamp
+}
+
+type pendingChange struct {
+	Id          int64         `db:"id"`
+	Version     int64         `db:"version"`
+	BaseVersion sql.NullInt64 `db:"base_version"`
+}
+
+type rowVersionReader interface {
+	From(from ...interface{}) *goqu.SelectDataset
+}
+
+func (conn *SqliteStreamDB) rowVersionTable() string {
+	return conn.prefix + rowVersionName
+}
+
+func (conn *SqliteStreamDB) clockTable() string {
+	return conn.prefix + clockName
+}
+
+func (conn *SqliteStreamDB) getRowVersion(
+	tx rowVersionReader,
+	tableName string,
+	rowKey []byte,
+) (rowVersion, bool, error) {
+	entry := rowVersionEntry{}
+	found, err := tx.From(conn.rowVersionTable()).
+		Select("version", "node_id", "base_version", "base_node_id").
+		Where(goqu.Ex{"table_name": tableName, "row_key": rowKey}).
+		Prepared(true).
+		ScanStruct(&entry)
+
+	if err != nil || !found {
+		return rowVersion{}, false, err
+	}
+
+	// Node IDs and clock readings are unsigned, SQLite only stores signed integers
+	return rowVersion{
+		Version: core.HLCTimestamp{Time: uint64(entry.Version), NodeID: uint64(entry.NodeID)},
+		Base:    core.HLCTimestamp{Time: uint64(entry.BaseVersion), NodeID: uint64(entry.BaseNodeID)},
+	}, true, nil
+}
+
+// isApplied checks if change with given version has been applied to row already
+func (v rowVersion) isApplied(version core.HLCTimestamp) bool {
+	return version.Compare(v.Version) == 0 || version.Compare(v.Base) <= 0
+}
+
+// recordRowVersion saves version of row if it's newer than the one stored, returns
+// false without any change if stored version is newer or same. Base never moves back.
+// Versions of deleted rows are kept as tombstones until tombstone_retention passes.
+func (conn *SqliteStreamDB) recordRowVersion(
+	tx *goqu.TxDatabase,
+	tableName string,
+	rowKey []byte,
+	version core.HLCTimestamp,
+	base core.HLCTimestamp,
+	deleted bool,
+) (bool, error) {
+	stored, found, err := conn.getRowVersion(tx, tableName, rowKey)
+	if err != nil {
+		return false, err
+	}
+
+	if found && version.Compare(stored.Version) <= 0 {
+		return false, nil
+	}
+
+	if found && base.Compare(stored.Base) < 0 {
+		base = stored.Base
+	}
+
+	_, err = tx.Insert(conn.rowVersionTable()).
+		Rows(goqu.Record{
+			"table_name":   tableName,
+			"row_key":      rowKey,
+			"version":      int64(version.Time),
+			"node_id":      int64(version.NodeID),
+			"base_version": int64(base.Time),
+			"base_node_id": int64(base.NodeID),
+			"deleted":      deleted,
+		}).
+		OnConflict(goqu.DoUpdate("table_name, row_key", goqu.Record{
+			"version":      goqu.I("excluded.version"),
+			"node_id":      goqu.I("excluded.node_id"),
+			"base_version": goqu.I("excluded.base_version"),
+			"base_node_id": goqu.I("excluded.base_node_id"),
+			"deleted":      goqu.I("excluded.deleted"),
+		})).
+		Prepared(true).
+		Executor().
+		Exec()
+
+	return err == nil, err
+}
+
+// CleanupTombstones removes versions of rows deleted before given time, changes made before
+// delete that arrive later are no longer rejected as stale
+func (conn *SqliteStreamDB) CleanupTombstones(beforeTime time.Time) (int64, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	rs, err := sqlConn.DB().Delete(conn.rowVersionTable()).
+		Where(
+			goqu.C("deleted").Eq(1),
+			goqu.C("version").Lt(int64(core.HLCTime(beforeTime))),
+		).
+		Prepared(true).
+		Executor().
+		Exec()
+	if err != nil {
+		return 0, err
+	}
+
+	return rs.RowsAffected()
+}
+
+// observeVersion moves persisted clock forward to replicated version, so that local changes
+// made afterwards are stamped with newer versions
+func (conn *SqliteStreamDB) observeVersion(tx *goqu.TxDatabase, version core.HLCTimestamp) error {
+	_, err := tx.Update(conn.clockTable()).
+		Set(goqu.Record{"value": goqu.Func("MAX", goqu.C("value"), int64(version.Time))}).
+		Where(goqu.C("id").Eq(1)).
+		Prepared(true).
+		Executor().
+		Exec()
+
+	return err
+}
+
+// localChange checks if row has local changes that are not published yet, returning version
+// of latest one. Row version is about to move past versions pending changes were based upon,
+// so they are pinned first to versions row had when each change was made.
+func (conn *SqliteStreamDB) localChange(
+	tx *goqu.TxDatabase,
+	event *ChangeLogEvent,
+	pkMap map[string]any,
+	stored core.HLCTimestamp,
+) (core.HLCTimestamp, bool, error) {
+	if !cfg.Config.Tables.CanPublish(event.TableName) {
+		return core.HLCTimestamp{}, false, nil
+	}
+
+	where := goqu.Ex{"state": Pending}
+	for k, v := range pkMap {
+		where["val_"+k] = v
+	}
+
+	changeLogTable := conn.metaTable(event.TableName, changeLogName)
+	pending := make([]pendingChange, 0)
+	err := tx.From(changeLogTable).
+		Select("id", "version", "base_version").
+		Where(where).
+		Order(goqu.C("id").Asc()).
+		Prepared(true).
+		ScanStructs(&pending)
+	if err != nil || len(pending) == 0 {
+		return core.HLCTimestamp{}, false, err
+	}
+
+	base := stored
+	for _, change := range pending {
+		if !change.BaseVersion.Valid {
+			_, err = tx.Update(changeLogTable).
+				Set(goqu.Record{"base_version": int64(base.Time), "base_node_id": int64(base.NodeID)}).
+				Where(goqu.C("id").Eq(change.Id)).
+				Prepared(true).
+				Executor().
+				Exec()
+			if err != nil {
+				return core.HLCTimestamp{}, false, err
+			}
+		}
+
+		base = core.HLCTimestamp{Time: uint64(change.Version), NodeID: cfg.Config.NodeID}
+	}
+
+	return base, true, nil
+}
+
+// stampBaseVersions sets version of row each local change was based upon, which is previous
+// change to same row or stored version of row, unless it was pinned already. Events must be
+// in order they were made.
+func (conn *SqliteStreamDB) stampBaseVersions(events []*ChangeLogEvent, pinned map[*ChangeLogEvent]bool) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	last := make(map[string]core.HLCTimestamp)
+	for _, event := range events {
+		key, err := rowKey(conn.getPrimaryKeyMap(event))
+		if err != nil {
+			return err
+		}
+
+		k := event.TableName + "\x00" + string(key)
+		if !pinned[event] {
+			if prev, ok := last[k]; ok {
+				event.BaseVersion = prev
+			} else {
+				stored, _, err := conn.getRowVersion(sqlConn.DB(), event.TableName, key)
+				if err != nil {
+					return err
+				}
+
+				event.BaseVersion = stored.Version
+			}
+		}
+
+		last[k] = event.Version
+	}
+
+	return nil
+}
+
+// stampLegacyChanges versions pending changes captured before change log had versions
+func (conn *SqliteStreamDB) stampLegacyChanges(gSQL *goqu.Database, tableName string) error {
+	return gSQL.WithTx(func(tx *goqu.TxDatabase) error {
+		clock := int64(0)
+		_, err := tx.From(conn.clockTable()).
+			Select("value").
+			Where(goqu.C("id").Eq(1)).
+			ScanVal(&clock)
+		if err != nil {
+			return err
+		}
+
+		now := int64(core.HLCTime(time.Now()))
+		if clock < now {
+			clock = now
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(stampLegacyChangesQuery, tableName), clock+1)
+		if err != nil {
+			return err
+		}
+
+		latest := sql.NullInt64{}
+		_, err = tx.From(tableName).
+			Select(goqu.MAX("version")).
+			Where(goqu.C("state").Eq(Pending)).
+			Prepared(true).
+			ScanVal(&latest)
+		if err != nil || !latest.Valid {
+			return err
+		}
+
+		return conn.observeVersion(tx, core.HLCTimestamp{Time: uint64(latest.Int64)})
+	})
+}
+
+func rowKey(pkMap map[string]any) ([]byte, error) {
+	names := make([]string, 0, len(pkMap))
+	for k := range pkMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pairs := make([][]any, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, []any{name, pkMap[name]})
+	}
+
+	return rowKeyEncMode.Marshal(pairs)
+}
@@ -0,0 +1,337 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/utils"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+)
+
+const dropChangeLogTableQuery = `DROP TABLE IF EXISTS %s`
+
+// TableSchemaChange describes a table that was created or altered on origin node,
+// CreateSQL is used when table is missing otherwise missing Columns are added
+type TableSchemaChange struct {
+	TableName string
+	CreateSQL string
+	Columns   []*ColumnInfo
+}
+
+// publishSchemaChanges publishes tables created or altered since last call, changes that failed
+// to publish are kept and published again along with later ones
+func (conn *SqliteStreamDB) publishSchemaChanges() error {
+	changes, err := conn.refreshSchema(nil)
+	if err != nil {
+		return err
+	}
+
+	pending := mergeSchemaChanges(conn.pendingSchema, changes)
+	if len(pending) == 0 || conn.OnChange == nil {
+		return nil
+	}
+
+	for _, change := range pending {
+		log.Info().
+			Str("table", change.TableName).
+			Int("columns", len(change.Columns)).
+			Msg("Publishing schema change")
+	}
+
+	err = conn.OnChange([]*ChangeLogTransaction{{Schema: pending}})
+	if err != nil {
+		conn.pendingSchema = pending
+		return err
+	}
+
+	conn.pendingSchema = nil
+	return nil
+}
+
+// mergeSchemaChanges appends changes to pending replacing older change of the same table
+func mergeSchemaChanges(pending []TableSchemaChange, changes []TableSchemaChange) []TableSchemaChange {
+	ret := make([]TableSchemaChange, 0, len(pending)+len(changes))
+	for _, change := range pending {
+		if !lo.ContainsBy(changes, func(c TableSchemaChange) bool { return c.TableName == change.TableName }) {
+			ret = append(ret, change)
+		}
+	}
+
+	return append(ret, changes...)
+}
+
+// refreshSchema compares tables in database against watched schema, regenerating change logs
+// and triggers for every created or altered table. When only is nil all tables are checked,
+// but only if schema version of database has changed since last refresh.
+func (conn *SqliteStreamDB) refreshSchema(only []string) ([]TableSchemaChange, error) {
+	conn.ddlLock.Lock()
+	defer conn.ddlLock.Unlock()
+
+	if only == nil {
+		version, err := conn.currentSchemaVersion()
+		if err != nil {
+			return nil, err
+		}
+
+		if version == conn.schemaVersion {
+			return nil, nil
+		}
+	}
+
+	changes, dropped, err := conn.diffSchema(only)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		log.Info().Str("table", change.TableName).Msg("Schema change detected, regenerating change log")
+		_, existed := conn.tableSchema(change.TableName)
+		conn.schemaLock.Lock()
+		conn.watchTablesSchema[change.TableName] = change.Columns
+		conn.schemaLock.Unlock()
+		forgetPKColumns(change.TableName)
+
+		// Rows written to new table before detection have no changes logged
+		err = conn.initTriggers(change.TableName, !existed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range dropped {
+		err = conn.unwatchTable(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn.schemaVersion, err = conn.currentSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (conn *SqliteStreamDB) diffSchema(only []string) ([]TableSchemaChange, []string, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sqlConn.Return()
+
+	changes := make([]TableSchemaChange, 0)
+	dropped := make([]string, 0)
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		names := make([]string, 0)
+		err := listDBTables(&names, tx)
+		if err != nil {
+			return err
+		}
+
+		names = lo.Filter(names, func(name string, _ int) bool {
+			return cfg.Config.Tables.IsWatched(name)
+		})
+
+		for _, name := range names {
+			if only != nil && !lo.Contains(only, name) {
+				continue
+			}
+
+			columns, err := getTableInfo(tx, name)
+			if err != nil {
+				return err
+			}
+
+			if existing, ok := conn.tableSchema(name); ok && utils.DeepEqualArray(existing, columns) {
+				continue
+			}
+
+			createSQL := ""
+			_, err = tx.From("sqlite_schema").
+				Select("sql").
+				Where(goqu.C("type").Eq("table"), goqu.C("name").Eq(name)).
+				Prepared(true).
+				ScanVal(&createSQL)
+			if err != nil {
+				return err
+			}
+
+			changes = append(changes, TableSchemaChange{
+				TableName: name,
+				CreateSQL: createSQL,
+				Columns:   columns,
+			})
+		}
+
+		for _, name := range conn.watchedTables() {
+			if only != nil && !lo.Contains(only, name) {
+				continue
+			}
+
+			if !lo.Contains(names, name) {
+				dropped = append(dropped, name)
+			}
+		}
+
+		return nil
+	})
+
+	return changes, dropped, err
+}
+
+func (conn *SqliteStreamDB) currentSchemaVersion() (int64, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	return getSchemaVersion(sqlConn.DB())
+}
+
+func (conn *SqliteStreamDB) unwatchTable(tableName string) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	// Drops aren't replicated, changes of dropped table that weren't published yet are lost
+	log.Info().Str("table", tableName).Msg("Table dropped, removing change log")
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		rs, err := tx.Delete(conn.globalMetaTable()).
+			Where(goqu.C("table_name").Eq(tableName)).
+			Prepared(true).
+			Executor().
+			Exec()
+		if err != nil {
+			return err
+		}
+
+		discarded, err := rs.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if discarded > 0 {
+			log.Warn().
+				Str("table", tableName).
+				Int64("changes", discarded).
+				Msg("Discarding unpublished changes of dropped table")
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(dropChangeLogTableQuery, conn.metaTable(tableName, changeLogName)))
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	conn.schemaLock.Lock()
+	delete(conn.watchTablesSchema, tableName)
+	conn.schemaLock.Unlock()
+	forgetPKColumns(tableName)
+	return nil
+}
+
+func (conn *SqliteStreamDB) applySchemaChanges(changes []TableSchemaChange) error {
+	err := conn.migrateSchema(changes)
+	if err != nil {
+		return err
+	}
+
+	tableNames := lo.Map(changes, func(c TableSchemaChange, _ int) string {
+		return c.TableName
+	})
+
+	_, err = conn.refreshSchema(tableNames)
+	return err
+}
+
+func (conn *SqliteStreamDB) migrateSchema(changes []TableSchemaChange) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	return sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		for _, change := range changes {
+			err := applyTableSchemaChange(tx, change)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func applyTableSchemaChange(tx *goqu.TxDatabase, change TableSchemaChange) error {
+	count := 0
+	_, err := tx.From("sqlite_schema").
+		Select(goqu.COUNT("*")).
+		Where(goqu.C("type").Eq("table"), goqu.C("name").Eq(change.TableName)).
+		Prepared(true).
+		ScanVal(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		log.Info().Str("table", change.TableName).Msg("Creating replicated table")
+		_, err = tx.Exec(change.CreateSQL)
+		return err
+	}
+
+	columns, err := getTableInfo(tx, change.TableName)
+	if err != nil {
+		return err
+	}
+
+	existing := lo.SliceToMap(columns, func(c *ColumnInfo) (string, bool) {
+		return c.Name, true
+	})
+
+	for _, col := range change.Columns {
+		// Primary key columns can't be added to an existing table
+		if existing[col.Name] || col.IsPrimaryKey {
+			continue
+		}
+
+		log.Info().
+			Str("table", change.TableName).
+			Str("column", col.Name).
+			Msg("Adding replicated column")
+		_, err = tx.Exec(fmt.Sprintf(addColumnQuery, change.TableName, col.Name, col.definition()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getSchemaVersion(gSQL *goqu.Database) (int64, error) {
+	version := int64(0)
+	err := gSQL.QueryRow("PRAGMA schema_version;").Scan(&version)
+	return version, err
+}
+
+func (c *ColumnInfo) definition() string {
+	parts := []string{c.Type}
+	if c.NotNull && c.DefaultValue != nil {
+		parts = append(parts, "NOT NULL")
+	}
+
+	if c.DefaultValue != nil {
+		parts = append(parts, fmt.Sprintf("DEFAULT %v", c.DefaultValue))
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestRefreshSchemaBackfillsNewTable(t *testing.T) {
+	conn, raw := openTestDB(t, "CREATE TABLE existing (id INTEGER PRIMARY KEY, v TEXT)")
+
+	// Rows written before new table is detected have no triggers to capture them
+	_, err := raw.Exec(`
+		CREATE TABLE created (id INTEGER PRIMARY KEY, v TEXT);
+		INSERT INTO created (id, v) VALUES (1, 'a'), (2, 'b');
+		INSERT INTO existing (id, v) VALUES (1, 'x');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := conn.refreshSchema(nil)
+	if err != nil {
+		t.Fatalf("refreshSchema() error = %v", err)
+	}
+
+	if len(changes) != 1 || changes[0].TableName != "created" || changes[0].CreateSQL == "" {
+		t.Fatalf("refreshSchema() = %+v, want creation of table created", changes)
+	}
+
+	// Rows written after detection are captured by triggers, not backfilled again
+	_, err = raw.Exec("INSERT INTO created (id, v) VALUES (3, 'c')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string][]int64)
+	for _, e := range pendingEvents(t, conn) {
+		if e.Type != "insert" || e.Version.IsZero() {
+			t.Errorf("event %+v isn't a versioned insert", e)
+		}
+
+		got[e.TableName] = append(got[e.TableName], e.Row["id"].(int64))
+	}
+
+	if len(got["created"]) != 3 || got["created"][0] != 1 || got["created"][2] != 3 {
+		t.Errorf("pending inserts of created = %v, want [1 2 3]", got["created"])
+	}
+
+	if len(got["existing"]) != 1 {
+		t.Errorf("pending inserts of existing = %v, want [1]", got["existing"])
+	}
+}
+
+func TestRefreshSchemaAlteredTableIsNotBackfilled(t *testing.T) {
+	conn, raw := openTestDB(t, "CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT); INSERT INTO t VALUES (1, 'a');")
+
+	_, err := raw.Exec("ALTER TABLE t ADD COLUMN w TEXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := conn.refreshSchema(nil)
+	if err != nil {
+		t.Fatalf("refreshSchema() error = %v", err)
+	}
+
+	if len(changes) != 1 || len(changes[0].Columns) != 3 {
+		t.Fatalf("refreshSchema() = %+v, want alteration of t", changes)
+	}
+
+	if events := pendingEvents(t, conn); len(events) != 0 {
+		t.Errorf("altered table has %d pending changes, want none", len(events))
+	}
+}
+
+func TestUnwatchTableDiscardsPendingChanges(t *testing.T) {
+	conn, raw := openTestDB(t, "CREATE TABLE t (id INTEGER PRIMARY KEY); CREATE TABLE kept (id INTEGER PRIMARY KEY);")
+	_, err := raw.Exec("INSERT INTO t VALUES (1); INSERT INTO kept VALUES (1); DROP TABLE t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.refreshSchema(nil)
+	if err != nil {
+		t.Fatalf("refreshSchema() error = %v", err)
+	}
+
+	if _, ok := conn.tableSchema("t"); ok {
+		t.Error("dropped table is still watched")
+	}
+
+	events := pendingEvents(t, conn)
+	if len(events) != 1 || events[0].TableName != "kept" {
+		t.Errorf("pending events = %+v, want only insert into kept", events)
+	}
+}
@@ -4,15 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/doug-martin/goqu/v9"
 	"github.com/fsnotify/fsnotify"
 	"github.com/mattn/go-sqlite3"
+	"github.com/maxpert/marmot/cfg"
 	"github.com/maxpert/marmot/pool"
 	"github.com/maxpert/marmot/telemetry"
 	"github.com/rs/zerolog/log"
@@ -20,24 +23,45 @@ import (
 
 const snapshotTransactionMode = "exclusive"
 
+// Replication reads row versions before writing, transactions must hold write
+// lock from the start or upgrading a stale read snapshot fails as busy
+const streamTransactionMode = "immediate"
+
 var PoolSize = 4
+var ErrIntegrityCheck = errors.New("database integrity check failed")
 var MarmotPrefix = "__marmot__"
 
 type statsSqliteStreamDB struct {
-	published      telemetry.Counter
-	pendingPublish telemetry.Gauge
-	countChanges   telemetry.Histogram
-	scanChanges    telemetry.Histogram
+	published          telemetry.Counter
+	staleSkipped       telemetry.Counter
+	conflicts          telemetry.Counter
+	pendingPublish     telemetry.Gauge
+	publishFailures    telemetry.Counter
+	failedChanges      telemetry.Gauge
+	publishBatchSize   telemetry.Histogram
+	publishLatency     telemetry.Histogram
+	replicateBatchSize telemetry.Histogram
+	replicateLatency   telemetry.Histogram
+	countChanges       telemetry.Histogram
+	scanChanges        telemetry.Histogram
 }
 
 type SqliteStreamDB struct {
-	OnChange      func(event *ChangeLogEvent) error
+	OnChange      func(txs []*ChangeLogTransaction) error
 	pool          *pool.SQLitePool
 	rawConnection *sqlite3.SQLiteConn
 	publishLock   *sync.Mutex
+	schemaLock    *sync.RWMutex
+	ddlLock       *sync.Mutex
+
+	// Guarded by publishLock
+	publishAttempts int
+	publishRetryAt  time.Time
+	pendingSchema   []TableSchemaChange
 
 	dbPath            string
 	prefix            string
+	schemaVersion     int64
 	watchTablesSchema map[string][]*ColumnInfo
 	stats             *statsSqliteStreamDB
 }
@@ -106,6 +130,28 @@ func RestoreFrom(destPath, bkFilePath string) error {
 	return nil
 }
 
+// CheckIntegrity runs integrity check on database file at path, failing with problems it found
+func CheckIntegrity(path string) error {
+	conn, rawConn, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro", path))
+	if err != nil {
+		return err
+	}
+	defer rawConn.Close()
+	defer conn.Close()
+
+	problems := make([]string, 0)
+	err = goqu.New("sqlite", conn).ScanVals(&problems, "PRAGMA integrity_check;")
+	if err != nil {
+		return err
+	}
+
+	if len(problems) == 1 && problems[0] == "ok" {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrIntegrityCheck, strings.Join(problems, "; "))
+}
+
 func GetAllDBTables(path string) ([]string, error) {
 	connectionStr := fmt.Sprintf("%s?_journal_mode=WAL", path)
 	conn, rawConn, err := pool.OpenRaw(connectionStr)
@@ -129,7 +175,21 @@ func GetAllDBTables(path string) ([]string, error) {
 }
 
 func OpenStreamDB(path string) (*SqliteStreamDB, error) {
-	dbPool, err := pool.NewSQLitePool(fmt.Sprintf("%s?_journal_mode=WAL", path), PoolSize, true)
+	err := validateConflictResolvers()
+	if err != nil {
+		return nil, err
+	}
+
+	dsn := fmt.Sprintf("%s?_journal_mode=WAL&_txlock=%s", path, streamTransactionMode)
+	if cfg.Config.ReplicationLog.DeferForeignKeys {
+		dsn += "&_foreign_keys=true"
+	}
+
+	dbPool, err := pool.NewSQLitePool(
+		dsn,
+		PoolSize,
+		true,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -150,27 +210,51 @@ func OpenStreamDB(path string) (*SqliteStreamDB, error) {
 		dbPath:            path,
 		prefix:            MarmotPrefix,
 		publishLock:       &sync.Mutex{},
+		schemaLock:        &sync.RWMutex{},
+		ddlLock:           &sync.Mutex{},
 		watchTablesSchema: map[string][]*ColumnInfo{},
 		stats: &statsSqliteStreamDB{
-			published:      telemetry.NewCounter("published", "number of rows published"),
-			pendingPublish: telemetry.NewGauge("pending_publish", "rows pending publishing"),
-			countChanges:   telemetry.NewHistogram("count_changes", "latency counting changes in microseconds"),
-			scanChanges:    telemetry.NewHistogram("scan_changes", "latency scanning change rows in DB"),
+			published:          telemetry.NewCounter("published", "number of rows published"),
+			staleSkipped:       telemetry.NewCounter("stale_skipped", "number of replicated rows skipped for being older than local version"),
+			conflicts:          telemetry.NewCounter("conflicts_resolved", "number of concurrently changed rows resolved"),
+			pendingPublish:     telemetry.NewGauge("pending_publish", "rows pending publishing"),
+			publishFailures:    telemetry.NewCounter("publish_failures", "number of failed attempts to publish a batch"),
+			failedChanges:      telemetry.NewGauge("failed_changes", "rows marked failed after exhausting publish retries"),
+			publishBatchSize:   telemetry.NewHistogram("publish_batch_size", "number of rows published per batch"),
+			publishLatency:     telemetry.NewHistogram("publish_latency", "latency publishing a batch and collecting acks in microseconds"),
+			replicateBatchSize: telemetry.NewHistogram("replicate_batch_size", "number of replicated transactions applied per database transaction"),
+			replicateLatency:   telemetry.NewHistogram("replicate_latency", "latency applying a batch of replicated transactions in microseconds"),
+			countChanges:       telemetry.NewHistogram("count_changes", "latency counting changes in microseconds"),
+			scanChanges:        telemetry.NewHistogram("scan_changes", "latency scanning change rows in DB"),
 		},
 	}
 
 	return ret, nil
 }
 
-func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
+// LoadTableSchemas loads schema of watched tables among given ones along with global tables, enough
+// for applying replicated changes without capturing local ones
+func (conn *SqliteStreamDB) LoadTableSchemas(tables []string) error {
+	if err := conn.initGlobalChangeLog(); err != nil {
+		return err
+	}
+
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
 	}
 	defer sqlConn.Return()
 
-	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+	return sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		conn.schemaLock.Lock()
+		defer conn.schemaLock.Unlock()
+
 		for _, n := range tables {
+			if !cfg.Config.Tables.IsWatched(n) {
+				log.Info().Str("table", n).Msg("Table excluded from watching")
+				continue
+			}
+
 			colInfo, err := getTableInfo(tx, n)
 			if err != nil {
 				return err
@@ -181,6 +265,24 @@ func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
 
 		return nil
 	})
+}
+
+func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
+	err := conn.LoadTableSchemas(tables)
+	if err != nil {
+		return err
+	}
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	err = removeStaleTriggers(sqlConn.DB(), conn.prefix, func(tableName string) bool {
+		_, watched := conn.tableSchema(tableName)
+		return watched && cfg.Config.Tables.CanPublish(tableName)
+	})
 	if err != nil {
 		return err
 	}
@@ -190,6 +292,18 @@ func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
 		return err
 	}
 
+	failed, err := conn.countFailedChanges()
+	if err != nil {
+		return err
+	}
+
+	conn.stats.failedChanges.Set(float64(failed))
+
+	conn.schemaVersion, err = getSchemaVersion(sqlConn.DB())
+	if err != nil {
+		return err
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
@@ -212,20 +326,17 @@ func (conn *SqliteStreamDB) RemoveCDC(tables bool) error {
 		return err
 	}
 
+	// Replication state survives cleanup, so that replication resumes where it left off
 	if tables {
-		return removeMarmotTables(sqlConn.DB(), conn.prefix)
+		return removeMarmotTables(sqlConn.DB(), conn.prefix, conn.replicationStateTable())
 	}
 
 	return nil
 }
 
 func (conn *SqliteStreamDB) installChangeLogTriggers() error {
-	if err := conn.initGlobalChangeLog(); err != nil {
-		return err
-	}
-
-	for tableName := range conn.watchTablesSchema {
-		err := conn.initTriggers(tableName)
+	for _, tableName := range conn.watchedTables() {
+		err := conn.initTriggers(tableName, false)
 		if err != nil {
 			return err
 		}
@@ -233,6 +344,26 @@ func (conn *SqliteStreamDB) installChangeLogTriggers() error {
 	return nil
 }
 
+func (conn *SqliteStreamDB) tableSchema(tableName string) ([]*ColumnInfo, bool) {
+	conn.schemaLock.RLock()
+	defer conn.schemaLock.RUnlock()
+
+	columns, ok := conn.watchTablesSchema[tableName]
+	return columns, ok
+}
+
+func (conn *SqliteStreamDB) watchedTables() []string {
+	conn.schemaLock.RLock()
+	defer conn.schemaLock.RUnlock()
+
+	names := make([]string, 0, len(conn.watchTablesSchema))
+	for name := range conn.watchTablesSchema {
+		names = append(names, name)
+	}
+
+	return names
+}
+
 func getTableInfo(tx *goqu.TxDatabase, table string) ([]*ColumnInfo, error) {
 	query := "SELECT name, type, `notnull`, dflt_value, pk FROM pragma_table_info(?)"
 	stmt, err := tx.Prepare(query)
@@ -280,53 +411,115 @@ func getTableInfo(tx *goqu.TxDatabase, table string) ([]*ColumnInfo, error) {
 	return tableInfo, nil
 }
 
-func (conn *SqliteStreamDB) BackupTo(bkFilePath string) error {
+// BackupTo writes copy of database without marmot tables to bkFilePath, returning sequences of
+// streams applied onto the copy. Sequences are recorded along with changes so they match the copy.
+func (conn *SqliteStreamDB) BackupTo(bkFilePath string) (map[string]uint64, error) {
 	sqlDB, rawDB, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro&_foreign_keys=false&_journal_mode=WAL", conn.dbPath))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer sqlDB.Close()
 	defer rawDB.Close()
 
 	_, err = rawDB.Exec("VACUUM main INTO ?;", []driver.Value{bkFilePath})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = rawDB.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = sqlDB.Close()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return conn.stripBackup(bkFilePath, true)
+}
+
+// BackupPagesTo is BackupTo copying database page for page with the online backup API, pages of
+// tables stay where they are between copies so that incremental snapshots only upload chunks with
+// changed pages. Pages of removed marmot tables are zeroed and left free instead of vacuumed.
+func (conn *SqliteStreamDB) BackupPagesTo(bkFilePath string) (map[string]uint64, error) {
+	srcDB, src, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro&_foreign_keys=false&_journal_mode=WAL", conn.dbPath))
+	if err != nil {
+		return nil, err
+	}
+	defer srcDB.Close()
+	defer src.Close()
+
+	destDB, dest, err := pool.OpenRaw(fmt.Sprintf("%s?_foreign_keys=false", bkFilePath))
+	if err != nil {
+		return nil, err
+	}
+	defer destDB.Close()
+	defer dest.Close()
+
+	bk, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = bk.Step(-1)
+	if err != nil {
+		bk.Finish()
+		return nil, err
 	}
 
+	err = bk.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	err = dest.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = destDB.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.stripBackup(bkFilePath, false)
+}
+
+// stripBackup removes marmot tables and triggers from copy of database at bkFilePath, returning
+// sequences recorded in copy
+func (conn *SqliteStreamDB) stripBackup(bkFilePath string, vacuum bool) (map[string]uint64, error) {
 	// Now since we have separate copy of DB we don't need to deal with WAL journals or foreign keys
-	// We need to remove all the marmot specific tables, triggers, and vacuum out the junk.
-	sqlDB, rawDB, err = pool.OpenRaw(fmt.Sprintf("%s?_foreign_keys=false&_journal_mode=TRUNCATE", bkFilePath))
+	sqlDB, _, err := pool.OpenRaw(fmt.Sprintf("%s?_foreign_keys=false&_journal_mode=TRUNCATE&_secure_delete=true", bkFilePath))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer sqlDB.Close()
 
 	gSQL := goqu.New("sqlite", sqlDB)
+	seq, err := loadSequences(gSQL, conn.replicationStateTable())
+	if err != nil {
+		return nil, err
+	}
+
 	err = removeMarmotTriggers(gSQL, conn.prefix)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = removeMarmotTables(gSQL, conn.prefix)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = gSQL.Exec("VACUUM;")
-	if err != nil {
-		return err
+	if vacuum {
+		_, err = gSQL.Exec("VACUUM;")
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	return seq, sqlDB.Close()
 }
 
 func (conn *SqliteStreamDB) GetRawConnection() *sqlite3.SQLiteConn {
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"database/sql"
+	"path"
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+// openTestDB creates database with given schema and opens it with change capture installed on
+// all of its tables, returning stream database along with a plain connection to it
+func openTestDB(t *testing.T, schema string) (*SqliteStreamDB, *sql.DB) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+	raw, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+
+	_, err = raw.Exec(schema)
+	if err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+
+	conn, err := OpenStreamDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenStreamDB() error = %v", err)
+	}
+
+	// Keeps background watcher from publishing changes tests inspect
+	conn.OnChange = func([]*ChangeLogTransaction) error { return ErrLogNotReadyToPublish }
+
+	names := make([]string, 0)
+	rows, err := raw.Query("SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rows.Next() {
+		name := ""
+		if err = rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, name)
+	}
+	rows.Close()
+
+	err = conn.InstallCDC(names)
+	if err != nil {
+		t.Fatalf("InstallCDC() error = %v", err)
+	}
+
+	return conn, raw
+}
+
+// pendingTransactions seals current commit group and loads every pending change as it would be
+// published
+func pendingTransactions(t *testing.T, conn *SqliteStreamDB) []*ChangeLogTransaction {
+	sealed, err := conn.sealCommitGroup()
+	if err != nil {
+		t.Fatalf("sealCommitGroup() error = %v", err)
+	}
+
+	changes, err := conn.getGlobalChanges(1000, sealed)
+	if err != nil {
+		t.Fatalf("getGlobalChanges() error = %v", err)
+	}
+
+	txs, err := conn.loadChangeLogTransactions(changes)
+	if err != nil {
+		t.Fatalf("loadChangeLogTransactions() error = %v", err)
+	}
+
+	return txs
+}
+
+func pendingEvents(t *testing.T, conn *SqliteStreamDB) []ChangeLogEvent {
+	return lo.FlatMap(pendingTransactions(t, conn), func(tx *ChangeLogTransaction, _ int) []ChangeLogEvent {
+		return tx.Events
+	})
+}
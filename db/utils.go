@@ -2,10 +2,14 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 
+	"github.com/doug-martin/goqu/v9"
 	"github.com/rs/zerolog/log"
 )
 
+const addColumnQuery = `ALTER TABLE %s ADD COLUMN %s %s`
+
 type EnhancedStatement struct {
 	*sql.Stmt
 }
@@ -51,3 +55,37 @@ func (rs *EnhancedRows) Finalize() {
 		log.Error().Err(err).Msg("Unable to close result set")
 	}
 }
+
+func addMissingColumns(gSQL *goqu.Database, tableName string, columns map[string]string) error {
+	existing := make([]string, 0)
+	err := gSQL.Select("name").
+		From(goqu.Func("pragma_table_info", tableName)).
+		ScanVals(&existing)
+	if err != nil {
+		return err
+	}
+
+	// Table doesn't exist yet, it will be created with all the columns
+	if len(existing) == 0 {
+		return nil
+	}
+
+	existingSet := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		existingSet[name] = true
+	}
+
+	for name, definition := range columns {
+		if existingSet[name] {
+			continue
+		}
+
+		log.Info().Str("table", tableName).Str("column", name).Msg("Adding missing column")
+		_, err = gSQL.Exec(fmt.Sprintf(addColumnQuery, tableName, name, definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const fileChunkSize = 1024 * 1024
+const fileSaltSize = 32
+
+var fileMagic = []byte("MRMTENC1")
+
+var ErrCorruptFile = errors.New("corrupt encrypted file")
+
+// EncryptStream writes content of src encrypted with active key to dst. Every stream is encrypted
+// with its own key derived from active key and a random salt, content is sealed in chunks with last
+// one marked so a truncated stream fails to decrypt. Header: magic | key ID length | key ID | salt.
+func EncryptStream(dst io.Writer, src io.Reader) error {
+	keyID, k, err := keyring.activeKey()
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, fileSaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(fileKey(k.raw, salt))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(dst)
+	header := append([]byte{}, fileMagic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = append(header, salt...)
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, fileChunkSize)
+	buf := make([]byte, fileChunkSize)
+	sealed := make([]byte, 0, fileChunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		last := byte(0)
+		if _, err = r.Peek(1); errors.Is(err, io.EOF) {
+			last = 1
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead.NonceSize(), counter), buf[:n], []byte{last})
+		chunkHeader := make([]byte, 5)
+		chunkHeader[0] = last
+		binary.BigEndian.PutUint32(chunkHeader[1:], uint32(len(sealed)))
+		_, err = w.Write(chunkHeader)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(sealed)
+		if err != nil {
+			return err
+		}
+
+		if last == 1 {
+			break
+		}
+	}
+
+	return w.Flush()
+}
+
+// DecryptStream writes decrypted content of src encrypted by EncryptStream to dst
+func DecryptStream(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+	prefix := make([]byte, len(fileMagic)+1)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil || !bytes.Equal(prefix[:len(fileMagic)], fileMagic) {
+		return ErrCorruptFile
+	}
+
+	keyID := make([]byte, prefix[len(fileMagic)])
+	salt := make([]byte, fileSaltSize)
+	_, err = io.ReadFull(r, keyID)
+	if err == nil {
+		_, err = io.ReadFull(r, salt)
+	}
+
+	if err != nil {
+		return ErrCorruptFile
+	}
+
+	if keyring == nil {
+		return fmt.Errorf("%w: %s, encryption is not enabled", ErrUnknownKey, keyID)
+	}
+
+	k, err := keyring.key(string(keyID))
+	if err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(fileKey(k.raw, salt))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(dst)
+	chunkHeader := make([]byte, 5)
+	buf := make([]byte, 0, fileChunkSize+aead.Overhead())
+	plain := make([]byte, 0, fileChunkSize)
+	for counter := uint64(0); ; counter++ {
+		_, err = io.ReadFull(r, chunkHeader)
+		if err != nil {
+			return ErrCorruptFile
+		}
+
+		size := binary.BigEndian.Uint32(chunkHeader[1:])
+		if size > fileChunkSize+uint32(aead.Overhead()) {
+			return ErrCorruptFile
+		}
+
+		buf = buf[:size]
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return ErrCorruptFile
+		}
+
+		last := chunkHeader[0]
+		plain, err = aead.Open(plain[:0], chunkNonce(aead.NonceSize(), counter), buf, []byte{last})
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCorruptFile, err)
+		}
+
+		_, err = w.Write(plain)
+		if err != nil {
+			return err
+		}
+
+		if last == 1 {
+			break
+		}
+	}
+
+	return w.Flush()
+}
+
+// IsEncryptedFile tells if file at path was written by EncryptStream
+func IsEncryptedFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	prefix := make([]byte, len(fileMagic))
+	_, err = io.ReadFull(f, prefix)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(prefix, fileMagic), nil
+}
+
+func fileKey(raw []byte, salt []byte) []byte {
+	mac := hmac.New(sha256.New, raw)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+func chunkNonce(size int, counter uint64) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
+}
@@ -0,0 +1,251 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+const keySize = 32
+const reloadCheckInterval = 5 * time.Second
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+var ErrInvalidKey = errors.New("invalid encryption key")
+var ErrNoActiveKey = errors.New("no active encryption key")
+
+var digestSalt = []byte("marmot-digest")
+
+var keyring *Keyring
+
+// Keyring holds encryption keys by ID, Active key encrypts while every key decrypts. Keyring file
+// is reloaded when it changes, so keys can be added and activated while nodes are running.
+type Keyring struct {
+	path    string
+	lock    *sync.RWMutex
+	active  string
+	keys    map[string]*key
+	modTime time.Time
+	checked time.Time
+}
+
+type key struct {
+	raw  []byte
+	aead cipher.AEAD
+}
+
+type keyringFile struct {
+	Active string            `toml:"active"`
+	Keys   map[string]string `toml:"keys"`
+}
+
+// Initialize loads configured keyring, encryption stays disabled unless it's enabled in configuration
+func Initialize() error {
+	if !cfg.Config.Encryption.Enable {
+		keyring = nil
+		return nil
+	}
+
+	k := &Keyring{path: cfg.Config.Encryption.Keyring, lock: &sync.RWMutex{}}
+	err := k.load()
+	if err != nil {
+		return err
+	}
+
+	keyring = k
+	return nil
+}
+
+// Enabled tells if payloads and snapshots are to be encrypted
+func Enabled() bool {
+	return keyring != nil
+}
+
+// Seal encrypts data with active key, returning ID of key used
+func Seal(data []byte) (string, []byte, error) {
+	keyID, k, err := keyring.activeKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	aead := k.aead
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyID, aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// Open decrypts data sealed with key keyID
+func Open(keyID string, data []byte) ([]byte, error) {
+	if keyring == nil {
+		return nil, fmt.Errorf("%w: %s, encryption is not enabled", ErrUnknownKey, keyID)
+	}
+
+	k, err := keyring.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	aead := k.aead
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+// ActiveKeyID returns ID of key Seal and NewDigest currently use
+func ActiveKeyID() (string, error) {
+	keyID, _, err := keyring.activeKey()
+	return keyID, err
+}
+
+// NewDigest returns HMAC-SHA256 keyed by key derived from key keyID, equal content has equal digest
+// under same key while digest tells nothing about content to anyone without key
+func NewDigest(keyID string) (hash.Hash, error) {
+	if keyring == nil {
+		return nil, fmt.Errorf("%w: %s, encryption is not enabled", ErrUnknownKey, keyID)
+	}
+
+	k, err := keyring.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return hmac.New(sha256.New, fileKey(k.raw, digestSalt)), nil
+}
+
+func (k *Keyring) activeKey() (string, *key, error) {
+	k.reloadIfChanged()
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	ret, ok := k.keys[k.active]
+	if !ok {
+		return "", nil, ErrNoActiveKey
+	}
+
+	return k.active, ret, nil
+}
+
+func (k *Keyring) key(keyID string) (*key, error) {
+	k.reloadIfChanged()
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	ret, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	return ret, nil
+}
+
+// reloadIfChanged reloads keyring file if it was modified, keeping current keys if it's unreadable
+func (k *Keyring) reloadIfChanged() {
+	k.lock.RLock()
+	due := time.Since(k.checked) >= reloadCheckInterval
+	k.lock.RUnlock()
+	if !due {
+		return
+	}
+
+	info, err := os.Stat(k.path)
+	if err == nil && !info.ModTime().Equal(k.modTime) {
+		err = k.load()
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Str("path", k.path).Msg("Unable to reload keyring, keeping loaded keys")
+	}
+
+	k.lock.Lock()
+	k.checked = time.Now()
+	k.lock.Unlock()
+}
+
+func (k *Keyring) load() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+
+	f, err := readKeyringFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*key, len(f.Keys))
+	for keyID, encoded := range f.Keys {
+		raw, err := decodeKey(keyID, encoded)
+		if err != nil {
+			return err
+		}
+
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return err
+		}
+
+		keys[keyID] = &key{raw: raw, aead: aead}
+	}
+
+	if _, ok := keys[f.Active]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoActiveKey, f.Active)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.active = f.Active
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.checked = time.Now()
+	log.Debug().Str("active", f.Active).Int("keys", len(keys)).Msg("Loaded keyring")
+	return nil
+}
+
+func readKeyringFile(path string) (*keyringFile, error) {
+	f := &keyringFile{}
+	_, err := toml.DecodeFile(path, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func decodeKey(keyID string, encoded string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != keySize {
+		return nil, fmt.Errorf("%w: %s must be %d base64 encoded bytes", ErrInvalidKey, keyID, keySize)
+	}
+
+	return raw, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
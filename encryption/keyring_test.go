@@ -0,0 +1,227 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	EnableTestKeyring(t, "k1", "k1", "k2")
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"short", []byte("hello")},
+		{"large", bytes.Repeat([]byte("marmot"), 100000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyID, sealed, err := Seal(tt.data)
+			if err != nil {
+				t.Fatalf("Seal() error = %v", err)
+			}
+
+			if keyID != "k1" {
+				t.Errorf("Seal() key ID = %s, want k1", keyID)
+			}
+
+			got, err := Open(keyID, sealed)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("Open() = %q, want %q", got, tt.data)
+			}
+
+			if _, err = Open("k2", sealed); err == nil {
+				t.Error("Open() with wrong key didn't fail")
+			}
+
+			if _, err = Open("k3", sealed); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("Open() with unknown key error = %v, want %v", err, ErrUnknownKey)
+			}
+
+			sealed[len(sealed)-1] ^= 1
+			if _, err = Open(keyID, sealed); err == nil {
+				t.Error("Open() of tampered data didn't fail")
+			}
+		})
+	}
+}
+
+func TestSealNonceIsRandom(t *testing.T) {
+	EnableTestKeyring(t, "k1", "k1")
+	_, a, err := Seal([]byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, b, err := Seal([]byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(a, b) {
+		t.Error("Seal() of same data produced same output")
+	}
+}
+
+func TestInitializeInvalidKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr error
+	}{
+		{"short key", "active = \"k1\"\n[keys]\nk1 = \"c2hvcnQ=\"\n", ErrInvalidKey},
+		{"missing active key", "active = \"k2\"\n[keys]\nk1 = \"" + base64.StdEncoding.EncodeToString(make([]byte, keySize)) + "\"\n", ErrNoActiveKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyringPath := path.Join(t.TempDir(), "keyring.toml")
+			err := os.WriteFile(keyringPath, []byte(tt.content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = useTestKeyring(t, keyringPath); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Initialize() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	EnableTestKeyring(t, "k1", "k1")
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"short", 10},
+		{"exactly one chunk", fileChunkSize},
+		{"several chunks", 2*fileChunkSize + 123},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i * 31)
+			}
+
+			encrypted := &bytes.Buffer{}
+			err := EncryptStream(encrypted, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("EncryptStream() error = %v", err)
+			}
+
+			if !bytes.HasPrefix(encrypted.Bytes(), fileMagic) {
+				t.Error("EncryptStream() output doesn't start with magic")
+			}
+
+			decrypted := &bytes.Buffer{}
+			err = DecryptStream(decrypted, bytes.NewReader(encrypted.Bytes()))
+			if err != nil {
+				t.Fatalf("DecryptStream() error = %v", err)
+			}
+
+			if !bytes.Equal(decrypted.Bytes(), data) {
+				t.Errorf("DecryptStream() returned %d bytes differing from %d encrypted", decrypted.Len(), len(data))
+			}
+		})
+	}
+}
+
+func TestDecryptStreamCorrupt(t *testing.T) {
+	EnableTestKeyring(t, "k1", "k1")
+	data := bytes.Repeat([]byte{1}, 2*fileChunkSize+10)
+	encrypted := &bytes.Buffer{}
+	err := EncryptStream(encrypted, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("EncryptStream() error = %v", err)
+	}
+
+	full := encrypted.Bytes()
+	tampered := append([]byte{}, full...)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not encrypted", data},
+		{"truncated header", full[:len(fileMagic)+2]},
+		{"truncated at chunk boundary", full[:len(full)-(10+16+5)]},
+		{"truncated mid chunk", full[:len(full)/2]},
+		{"tampered", tampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DecryptStream(&bytes.Buffer{}, bytes.NewReader(tt.data))
+			if !errors.Is(err, ErrCorruptFile) {
+				t.Errorf("DecryptStream() error = %v, want %v", err, ErrCorruptFile)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keyringPath := EnableTestKeyring(t, "k1", "k1")
+	oldKeyID, sealed, err := Seal([]byte("before rotation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	WriteTestKeyring(t, keyringPath, "k2", "k1", "k2")
+	err = keyring.load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	keyID, _, err := Seal([]byte("after rotation"))
+	if err != nil || keyID != "k2" {
+		t.Fatalf("Seal() key ID = %s, %v, want k2", keyID, err)
+	}
+
+	got, err := Open(oldKeyID, sealed)
+	if err != nil || string(got) != "before rotation" {
+		t.Errorf("Open() with rotated out key = %q, %v", got, err)
+	}
+}
+
+func TestNewDigest(t *testing.T) {
+	EnableTestKeyring(t, "k1", "k1", "k2")
+	digest := func(keyID string, data string) []byte {
+		h, err := NewDigest(keyID)
+		if err != nil {
+			t.Fatalf("NewDigest() error = %v", err)
+		}
+
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	if !bytes.Equal(digest("k1", "a"), digest("k1", "a")) {
+		t.Error("digests of same content with same key differ")
+	}
+
+	if bytes.Equal(digest("k1", "a"), digest("k1", "b")) {
+		t.Error("digests of different content are equal")
+	}
+
+	if bytes.Equal(digest("k1", "a"), digest("k2", "a")) {
+		t.Error("digests with different keys are equal")
+	}
+
+	if _, err := NewDigest("k3"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("NewDigest() with unknown key error = %v, want %v", err, ErrUnknownKey)
+	}
+}
@@ -0,0 +1,55 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+// WriteTestKeyring writes keyring file of given keys for tests, key material of each key is
+// its position repeated so keys stay same across runs
+func WriteTestKeyring(t testing.TB, keyringPath string, active string, keyIDs ...string) {
+	t.Helper()
+	content := fmt.Sprintf("active = %q\n[keys]\n", active)
+	for i, keyID := range keyIDs {
+		raw := bytes.Repeat([]byte{byte(i + 1)}, keySize)
+		content += fmt.Sprintf("%s = %q\n", keyID, base64.StdEncoding.EncodeToString(raw))
+	}
+
+	err := os.WriteFile(keyringPath, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// EnableTestKeyring enables encryption with temporary keyring of given keys until test ends,
+// returning path of keyring file
+func EnableTestKeyring(t testing.TB, active string, keyIDs ...string) string {
+	t.Helper()
+	keyringPath := path.Join(t.TempDir(), "keyring.toml")
+	WriteTestKeyring(t, keyringPath, active, keyIDs...)
+
+	err := useTestKeyring(t, keyringPath)
+	if err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+
+	return keyringPath
+}
+
+// useTestKeyring initializes encryption with keyring file until test ends
+func useTestKeyring(t testing.TB, keyringPath string) error {
+	encryptionCfg := cfg.Config.Encryption
+	cfg.Config.Encryption = cfg.EncryptionConfiguration{Enable: true, Keyring: keyringPath}
+	t.Cleanup(func() {
+		cfg.Config.Encryption = encryptionCfg
+		_ = Initialize()
+	})
+
+	return Initialize()
+}
@@ -0,0 +1,140 @@
+package logstream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/encryption"
+	"github.com/nats-io/nats.go"
+)
+
+const codecHeader = "Marmot-Codec"
+const keyIDHeader = "Marmot-Key-Id"
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var ErrUnknownCodec = errors.New("unknown payload codec")
+
+// payloadCodec encodes published payloads with configured codec and decodes payloads of any codec,
+// codec travels in message header so nodes with different codecs can share streams. Encoders and
+// decoders are safe for concurrent use and shared by all messages.
+type payloadCodec struct {
+	codec        cfg.PayloadCodec
+	zstdEncoder  *zstd.Encoder
+	zstdDecoder  *zstd.Decoder
+	dictEncoders map[string]*zstd.Encoder
+}
+
+// newPayloadCodec loads zstd dictionaries of tables, all nodes need same dictionaries to decode
+// payloads encoded with them
+func newPayloadCodec(codec cfg.PayloadCodec, dictPaths map[string]string) (*payloadCodec, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dicts := make([][]byte, 0, len(dictPaths))
+	dictEncoders := make(map[string]*zstd.Encoder, len(dictPaths))
+	for table, path := range dictPaths {
+		dict, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		dictEnc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict))
+		if err != nil {
+			return nil, fmt.Errorf("dictionary of %s: %w", table, err)
+		}
+
+		dicts = append(dicts, dict)
+		dictEncoders[table] = dictEnc
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &payloadCodec{
+		codec:        codec,
+		zstdEncoder:  enc,
+		zstdDecoder:  dec,
+		dictEncoders: dictEncoders,
+	}, nil
+}
+
+// encode returns payload encoded for publishing along with headers describing it. Encoded
+// payload is encrypted when encryption is enabled, with ID of key used in header.
+func (c *payloadCodec) encode(table string, payload []byte) ([]byte, nats.Header, error) {
+	payload, codec := c.compress(table, payload)
+	header := nats.Header{}
+	header.Set(codecHeader, string(codec))
+	if !encryption.Enabled() {
+		return payload, header, nil
+	}
+
+	keyID, sealed, err := encryption.Seal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header.Set(keyIDHeader, keyID)
+	return sealed, header, nil
+}
+
+// compress returns payload compressed with configured codec along with codec used, table picks
+// dictionary for zstd-dict codec and tables without one fall back to zstd
+func (c *payloadCodec) compress(table string, payload []byte) ([]byte, cfg.PayloadCodec) {
+	switch c.codec {
+	case cfg.ZstdDictCodec:
+		if enc, ok := c.dictEncoders[table]; ok {
+			return enc.EncodeAll(payload, nil), cfg.ZstdDictCodec
+		}
+
+		return c.zstdEncoder.EncodeAll(payload, nil), cfg.ZstdCodec
+	case cfg.ZstdCodec:
+		return c.zstdEncoder.EncodeAll(payload, nil), cfg.ZstdCodec
+	case cfg.S2Codec:
+		return s2.Encode(nil, payload), cfg.S2Codec
+	}
+
+	return payload, cfg.NoCodec
+}
+
+// decode returns payload of message published with any codec, decrypting it first if it was
+// encrypted. Messages of older versions carry no header, they are either zstd frames or plain
+// CBOR which never starts with zstd magic.
+func (c *payloadCodec) decode(msg *nats.Msg) ([]byte, error) {
+	data := msg.Data
+	if keyID := msg.Header.Get(keyIDHeader); keyID != "" {
+		var err error
+		data, err = encryption.Open(keyID, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	codec := cfg.PayloadCodec(msg.Header.Get(codecHeader))
+	if codec == "" {
+		codec = cfg.NoCodec
+		if bytes.HasPrefix(data, zstdMagic) {
+			codec = cfg.ZstdCodec
+		}
+	}
+
+	switch codec {
+	case cfg.NoCodec:
+		return data, nil
+	case cfg.ZstdCodec, cfg.ZstdDictCodec:
+		return c.zstdDecoder.DecodeAll(data, nil)
+	case cfg.S2Codec:
+		return s2.Decode(nil, data)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, codec)
+}
@@ -0,0 +1,153 @@
+package logstream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/encryption"
+	"github.com/nats-io/nats.go"
+)
+
+func testPayload() []byte {
+	return bytes.Repeat([]byte(`{"table":"orders","row":{"id":1,"customer":"someone"}}`), 20)
+}
+
+func testDictionary(t *testing.T) string {
+	samples := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"table":"orders","row":{"id":%d,"customer":"someone %d"}}`, i, i)))
+	}
+
+	d, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 1})
+	if err != nil {
+		t.Fatalf("BuildZstdDict() error = %v", err)
+	}
+
+	dictPath := path.Join(t.TempDir(), "orders.dict")
+	err = os.WriteFile(dictPath, d, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dictPath
+}
+
+func TestPayloadCodecRoundTrip(t *testing.T) {
+	dictPath := testDictionary(t)
+	tests := []struct {
+		name      string
+		codec     cfg.PayloadCodec
+		table     string
+		encrypted bool
+		wantCodec cfg.PayloadCodec
+	}{
+		{"none", cfg.NoCodec, "orders", false, cfg.NoCodec},
+		{"zstd", cfg.ZstdCodec, "orders", false, cfg.ZstdCodec},
+		{"s2", cfg.S2Codec, "orders", false, cfg.S2Codec},
+		{"zstd-dict", cfg.ZstdDictCodec, "orders", false, cfg.ZstdDictCodec},
+		{"zstd-dict without dictionary falls back to zstd", cfg.ZstdDictCodec, "items", false, cfg.ZstdCodec},
+		{"encrypted zstd", cfg.ZstdCodec, "orders", true, cfg.ZstdCodec},
+		{"encrypted none", cfg.NoCodec, "orders", true, cfg.NoCodec},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.encrypted {
+				encryption.EnableTestKeyring(t, "k1", "k1")
+			}
+
+			c, err := newPayloadCodec(tt.codec, map[string]string{"orders": dictPath})
+			if err != nil {
+				t.Fatalf("newPayloadCodec() error = %v", err)
+			}
+
+			payload := testPayload()
+			data, header, err := c.encode(tt.table, payload)
+			if err != nil {
+				t.Fatalf("encode() error = %v", err)
+			}
+
+			if got := cfg.PayloadCodec(header.Get(codecHeader)); got != tt.wantCodec {
+				t.Errorf("codec header = %s, want %s", got, tt.wantCodec)
+			}
+
+			if got := header.Get(keyIDHeader); (got != "") != tt.encrypted {
+				t.Errorf("key ID header = %q, encrypted %v", got, tt.encrypted)
+			}
+
+			if tt.encrypted && bytes.Contains(data, []byte("orders")) {
+				t.Error("encrypted payload contains plain text")
+			}
+
+			// Decoding node doesn't need to share encoding node's codec
+			decoder, err := newPayloadCodec(cfg.NoCodec, map[string]string{"orders": dictPath})
+			if err != nil {
+				t.Fatalf("newPayloadCodec() error = %v", err)
+			}
+
+			got, err := decoder.decode(&nats.Msg{Data: data, Header: header})
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Errorf("decode() = %q, want %q", got, payload)
+			}
+		})
+	}
+}
+
+func TestPayloadCodecDecodeLegacy(t *testing.T) {
+	c, err := newPayloadCodec(cfg.ZstdCodec, nil)
+	if err != nil {
+		t.Fatalf("newPayloadCodec() error = %v", err)
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := testPayload()
+	tests := []struct {
+		name string
+		msg  *nats.Msg
+	}{
+		{"headerless zstd", &nats.Msg{Data: enc.EncodeAll(payload, nil)}},
+		{"headerless plain", &nats.Msg{Data: payload}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.decode(tt.msg)
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Errorf("decode() = %q, want %q", got, payload)
+			}
+		})
+	}
+}
+
+func TestPayloadCodecDecodeUnknown(t *testing.T) {
+	c, err := newPayloadCodec(cfg.NoCodec, nil)
+	if err != nil {
+		t.Fatalf("newPayloadCodec() error = %v", err)
+	}
+
+	header := nats.Header{}
+	header.Set(codecHeader, "lz4")
+	_, err = c.decode(&nats.Msg{Data: testPayload(), Header: header})
+	if !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("decode() error = %v, want %v", err, ErrUnknownCodec)
+	}
+}
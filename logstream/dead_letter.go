@@ -0,0 +1,217 @@
+package logstream
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/encryption"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deadLetterErrorHeader     = "Marmot-Error"
+	deadLetterOriginHeader    = "Marmot-Origin-Node"
+	deadLetterNodeHeader      = "Marmot-Node"
+	deadLetterStreamHeader    = "Marmot-Stream"
+	deadLetterStreamSeqHeader = "Marmot-Stream-Seq"
+)
+
+// Error messages may quote replicated values, so error header is kept on one line of bounded length
+const maxDeadLetterErrorLen = 1024
+
+// DeadLetterEntry is a replicated entry that could not be applied on node, Payload is
+// decoded replication event same as passed to ReplicationListener
+type DeadLetterEntry struct {
+	Seq        uint64
+	Time       time.Time
+	Stream     string
+	StreamSeq  uint64
+	OriginNode uint64
+	Node       uint64
+	Error      string
+	Payload    []byte
+}
+
+func (r *Replicator) deadLetterStream() (nats.JetStreamContext, error) {
+	js, err := r.client.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	streamCfg := makeDeadLetterStreamConfig(r.currentSet().shards)
+	_, err = js.StreamInfo(streamCfg.Name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		log.Debug().Str("name", streamCfg.Name).Msg("Creating dead-letter stream")
+		_, err = js.AddStream(streamCfg)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return js, nil
+}
+
+// deadLetter moves entry that failed with cause to dead-letter stream
+func (r *Replicator) deadLetter(strName string, seq uint64, msg *nats.Msg, cause error) error {
+	payload, err := r.decodePayload(msg)
+	if err != nil {
+		payload = msg.Data
+	}
+
+	js, err := r.deadLetterStream()
+	if err != nil {
+		return err
+	}
+
+	dlMsg := nats.NewMsg(deadLetterSubjectName())
+	dlMsg.Data = payload
+	if encryption.Enabled() {
+		keyID, sealed, err := encryption.Seal(payload)
+		if err != nil {
+			return err
+		}
+
+		dlMsg.Data = sealed
+		dlMsg.Header.Set(keyIDHeader, keyID)
+	}
+
+	dlMsg.Header.Set(deadLetterErrorHeader, headerValue(cause.Error(), maxDeadLetterErrorLen))
+	dlMsg.Header.Set(deadLetterOriginHeader, strconv.FormatUint(originNodeID(payload), 10))
+	dlMsg.Header.Set(deadLetterNodeHeader, strconv.FormatUint(r.nodeID, 10))
+	dlMsg.Header.Set(deadLetterStreamHeader, strName)
+	dlMsg.Header.Set(deadLetterStreamSeqHeader, strconv.FormatUint(seq, 10))
+
+	ack, err := js.PublishMsg(dlMsg)
+	if err != nil {
+		return err
+	}
+
+	r.deadLettered.Inc()
+	log.Warn().
+		Err(cause).
+		Str("stream", strName).
+		Uint64("seq", seq).
+		Uint64("dead_letter_seq", ack.Sequence).
+		Msg("Moved entry to dead-letter stream")
+	return nil
+}
+
+// headerValue replaces line breaks and control characters, which would break header framing,
+// and truncates value to max bytes
+func headerValue(v string, max int) string {
+	v = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+
+		return r
+	}, v)
+
+	if len(v) <= max {
+		return v
+	}
+
+	v = v[:max]
+	for !utf8.ValidString(v) {
+		v = v[:len(v)-1]
+	}
+
+	return v
+}
+
+// DeadLetters lists entries of dead-letter stream from all nodes
+func (r *Replicator) DeadLetters() ([]*DeadLetterEntry, error) {
+	js, err := r.deadLetterStream()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := js.StreamInfo(deadLetterStreamName())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*DeadLetterEntry, 0, info.State.Msgs)
+	if info.State.Msgs == 0 {
+		return ret, nil
+	}
+
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq; seq++ {
+		msg, err := js.GetMsg(deadLetterStreamName(), seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		payload := msg.Data
+		if keyID := msg.Header.Get(keyIDHeader); keyID != "" {
+			payload, err = encryption.Open(keyID, msg.Data)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		streamSeq, _ := strconv.ParseUint(msg.Header.Get(deadLetterStreamSeqHeader), 10, 64)
+		originNode, _ := strconv.ParseUint(msg.Header.Get(deadLetterOriginHeader), 10, 64)
+		node, _ := strconv.ParseUint(msg.Header.Get(deadLetterNodeHeader), 10, 64)
+		ret = append(ret, &DeadLetterEntry{
+			Seq:        msg.Sequence,
+			Time:       msg.Time,
+			Stream:     msg.Header.Get(deadLetterStreamHeader),
+			StreamSeq:  streamSeq,
+			OriginNode: originNode,
+			Node:       node,
+			Error:      msg.Header.Get(deadLetterErrorHeader),
+			Payload:    payload,
+		})
+	}
+
+	return ret, nil
+}
+
+// RetryDeadLetter applies entry again with callback, entry is removed once it's applied
+func (r *Replicator) RetryDeadLetter(entry *DeadLetterEntry, callback ReplicationListener) error {
+	err := callback(entry.Stream, entry.StreamSeq, []ReplicationEntry{{Seq: entry.StreamSeq, Payload: entry.Payload}})
+	if err != nil {
+		return err
+	}
+
+	return r.DiscardDeadLetter(entry)
+}
+
+// DiscardDeadLetter removes entry from dead-letter stream
+func (r *Replicator) DiscardDeadLetter(entry *DeadLetterEntry) error {
+	js, err := r.deadLetterStream()
+	if err != nil {
+		return err
+	}
+
+	return js.DeleteMsg(deadLetterStreamName(), entry.Seq)
+}
+
+func makeDeadLetterStreamConfig(totalShards uint64) *nats.StreamConfig {
+	streamCfg := makeShardStreamConfig(0, 0, totalShards, false)
+	streamCfg.Name = deadLetterStreamName()
+	streamCfg.Subjects = []string{deadLetterSubjectName()}
+	streamCfg.MaxMsgs = -1
+	streamCfg.Duplicates = 0
+	streamCfg.DenyDelete = false
+	return streamCfg
+}
+
+func deadLetterStreamName() string {
+	return cfg.Config.NATS.StreamPrefix + "-dlq"
+}
+
+func deadLetterSubjectName() string {
+	return cfg.Config.NATS.SubjectPrefix + "-dlq"
+}
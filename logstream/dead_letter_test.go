@@ -0,0 +1,121 @@
+package logstream
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+var errTestApply = errors.New("can't apply\nentry")
+
+func failOn(body string) func(string) error {
+	return func(b string) error {
+		if b == body {
+			return errTestApply
+		}
+
+		return nil
+	}
+}
+
+func TestDeadLetterAndRetry(t *testing.T) {
+	startTestServer(t)
+	cfg.Config.ReplicationLog.FailurePolicy = cfg.DeadLetterOnFailure
+	store := newMemStateStore()
+	r := newTestReplicator(t, store)
+
+	publishTestEntries(t, r, "a", "poison", "b", "stop")
+	got := listenUntil(t, r, store, "stop", failOn("poison"))
+	if !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("applied %v, want [a b]", got)
+	}
+
+	entries, err := r.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters() error = %v", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("DeadLetters() = %d entries, want 1", len(entries))
+	}
+
+	entry := entries[0]
+	if entryBody(t, entry.Payload) != "poison" || entry.StreamSeq != 2 || entry.Stream != r.currentSet().streamName(1) {
+		t.Errorf("dead-letter entry = %+v", entry)
+	}
+
+	if entry.Node != testNodeID || entry.OriginNode != testNodeID+1 {
+		t.Errorf("dead-letter entry node = %d, origin = %d", entry.Node, entry.OriginNode)
+	}
+
+	if entry.Error != strings.ReplaceAll(errTestApply.Error(), "\n", " ") {
+		t.Errorf("dead-letter entry error = %q", entry.Error)
+	}
+
+	// Entry stays until it's applied
+	err = r.RetryDeadLetter(entry, func(string, uint64, []ReplicationEntry) error { return errTestApply })
+	if !errors.Is(err, errTestApply) {
+		t.Errorf("RetryDeadLetter() error = %v, want %v", err, errTestApply)
+	}
+
+	retried := make([]string, 0)
+	err = r.RetryDeadLetter(entry, func(streamName string, seq uint64, entries []ReplicationEntry) error {
+		if streamName != entry.Stream || seq != entry.StreamSeq {
+			t.Errorf("retried at %s:%d, want %s:%d", streamName, seq, entry.Stream, entry.StreamSeq)
+		}
+
+		for _, e := range entries {
+			retried = append(retried, entryBody(t, e.Payload))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RetryDeadLetter() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(retried, []string{"poison"}) {
+		t.Errorf("retried %v, want [poison]", retried)
+	}
+
+	if entries, err = r.DeadLetters(); err != nil || len(entries) != 0 {
+		t.Errorf("DeadLetters() after retry = %d entries, %v", len(entries), err)
+	}
+}
+
+func TestHaltOnFailure(t *testing.T) {
+	startTestServer(t)
+	cfg.Config.ReplicationLog.FailurePolicy = cfg.HaltOnFailure
+	store := newMemStateStore()
+	r := newTestReplicator(t, store)
+
+	publishTestEntries(t, r, "a", "poison", "b")
+	applied := make([]string, 0)
+	err := r.Listen(func(streamName string, seq uint64, entries []ReplicationEntry) error {
+		for _, entry := range entries {
+			body := entryBody(t, entry.Payload)
+			if body == "poison" {
+				return errTestApply
+			}
+
+			applied = append(applied, body)
+		}
+
+		return store.SaveSequence(streamName, seq)
+	})
+	if !errors.Is(err, errTestApply) {
+		t.Errorf("Listen() error = %v, want %v", err, errTestApply)
+	}
+
+	if !reflect.DeepEqual(applied, []string{"a"}) {
+		t.Errorf("applied %v, want [a]", applied)
+	}
+
+	seq, _ := store.LoadSequences()
+	if got := seq[r.currentSet().streamName(1)]; got != 1 {
+		t.Errorf("saved sequence = %d, want 1", got)
+	}
+}
@@ -1,13 +1,28 @@
 package logstream
 
 import (
+	"encoding/binary"
+
 	"github.com/fxamacker/cbor/v2"
 	"github.com/maxpert/marmot/core"
+	"github.com/maxpert/marmot/signing"
 )
 
+// ReplicationEvent is payload published by node FromNodeId. Signature if present signs
+// node ID along with payload exactly as it was encoded.
 type ReplicationEvent[T core.ReplicableEvent[T]] struct {
 	FromNodeId uint64
 	Payload    T
+	Signature  []byte
+
+	signed []byte
+}
+
+// encodedReplicationEvent keeps encoded payload, older versions decode it as ReplicationEvent
+type encodedReplicationEvent struct {
+	FromNodeId uint64
+	Payload    cbor.RawMessage
+	Signature  []byte `cbor:",omitempty"`
 }
 
 func (e *ReplicationEvent[T]) Marshal() ([]byte, error) {
@@ -16,30 +31,77 @@ func (e *ReplicationEvent[T]) Marshal() ([]byte, error) {
 		return nil, err
 	}
 
-	ev := ReplicationEvent[T]{
-		FromNodeId: e.FromNodeId,
-		Payload:    wrappedPayload,
+	em, err := cbor.EncOptions{}.EncModeWithTags(core.CBORTags)
+	if err != nil {
+		return nil, err
 	}
 
-	em, err := cbor.EncOptions{}.EncModeWithTags(core.CBORTags)
+	payload, err := em.Marshal(wrappedPayload)
 	if err != nil {
 		return nil, err
 	}
 
+	ev := encodedReplicationEvent{
+		FromNodeId: e.FromNodeId,
+		Payload:    payload,
+	}
+
+	if signing.Enabled() {
+		ev.Signature = signing.Sign(signedData(e.FromNodeId, payload))
+	}
+
 	return em.Marshal(ev)
 }
 
+// Verify checks signature of unmarshalled event
+func (e *ReplicationEvent[T]) Verify() error {
+	return signing.Verify(e.FromNodeId, e.signed, e.Signature)
+}
+
+func signedData(nodeID uint64, payload []byte) []byte {
+	data := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint64(data, nodeID)
+	return append(data, payload...)
+}
+
+// originNodeID reads node that published payload without decoding rest of it, 0 if unknown
+func originNodeID(data []byte) uint64 {
+	dm, err := cbor.DecOptions{}.DecModeWithTags(core.CBORTags)
+	if err != nil {
+		return 0
+	}
+
+	ev := struct {
+		FromNodeId uint64
+	}{}
+	if err = dm.Unmarshal(data, &ev); err != nil {
+		return 0
+	}
+
+	return ev.FromNodeId
+}
+
 func (e *ReplicationEvent[T]) Unmarshal(data []byte) error {
 	dm, err := cbor.DecOptions{}.DecModeWithTags(core.CBORTags)
 	if err != nil {
 		return nil
 	}
 
-	err = dm.Unmarshal(data, e)
+	ev := encodedReplicationEvent{}
+	err = dm.Unmarshal(data, &ev)
+	if err != nil {
+		return err
+	}
+
+	err = dm.Unmarshal(ev.Payload, &e.Payload)
 	if err != nil {
 		return err
 	}
 
+	e.FromNodeId = ev.FromNodeId
+	e.Signature = ev.Signature
+	e.signed = signedData(ev.FromNodeId, ev.Payload)
+
 	e.Payload, err = e.Payload.Unwrap()
 	if err != nil {
 		return err
@@ -2,53 +2,85 @@ package logstream
 
 import (
 	"errors"
-	"io"
 	"os"
 	"sync"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
 )
 
 var ErrNotInitialized = errors.New("not initialized")
 
+// ReplicationStateStore persists last applied sequence of every stream
+type ReplicationStateStore interface {
+	LoadSequences() (map[string]uint64, error)
+	SaveSequence(streamName string, seq uint64) error
+}
+
 type replicationState struct {
-	seq  map[string]uint64
-	lock *sync.RWMutex
-	fl   *os.File
+	seq   map[string]uint64
+	lock  *sync.RWMutex
+	store ReplicationStateStore
 }
 
-func (r *replicationState) init() error {
-	fl, err := os.OpenFile(cfg.Config.SeqMapPath, os.O_RDWR|os.O_CREATE|os.O_SYNC, 0666)
+func (r *replicationState) init(store ReplicationStateStore) error {
+	seq, err := store.LoadSequences()
 	if err != nil {
 		return err
 	}
 
-	r.seq = make(map[string]uint64)
 	r.lock = &sync.RWMutex{}
-	r.fl = fl
+	r.store = store
+	r.seq = seq
+	if len(seq) != 0 {
+		return nil
+	}
+
+	return r.migrateSeqMap()
+}
+
+// migrateSeqMap moves sequences saved by older versions in seq_map_path file into store
+func (r *replicationState) migrateSeqMap() error {
+	fl, err := os.Open(cfg.Config.SeqMapPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 
-	idx, err := fl.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
+	defer fl.Close()
 
-	if idx < 1 {
+	seq := make(map[string]uint64)
+	err = cbor.NewDecoder(fl).Decode(&seq)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("path", cfg.Config.SeqMapPath).
+			Msg("Unable to read sequence map, ignoring...")
 		return nil
 	}
 
-	_, err = fl.Seek(0, io.SeekStart)
-	if err != nil {
-		return err
+	for streamName, s := range seq {
+		_, err = r.save(streamName, s)
+		if err != nil {
+			return err
+		}
 	}
 
-	return cbor.NewDecoder(fl).Decode(&r.seq)
+	log.Info().
+		Str("path", cfg.Config.SeqMapPath).
+		Int("streams", len(seq)).
+		Msg("Migrated sequence map into database")
+	return os.Rename(cfg.Config.SeqMapPath, cfg.Config.SeqMapPath+".migrated")
 }
 
+// save persists seq for stream, unless a later sequence is already saved
 func (r *replicationState) save(streamName string, seq uint64) (uint64, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	if r.fl == nil {
+	if r.store == nil {
 		return 0, ErrNotInitialized
 	}
 
@@ -56,19 +88,35 @@ func (r *replicationState) save(streamName string, seq uint64) (uint64, error) {
 		return old, nil
 	}
 
-	_, err := r.fl.Seek(0, io.SeekStart)
+	err := r.store.SaveSequence(streamName, seq)
 	if err != nil {
 		return 0, err
 	}
-	defer r.fl.Sync()
 
 	r.seq[streamName] = seq
-	err = cbor.NewEncoder(r.fl).Encode(r.seq)
-	if err != nil {
-		return 0, err
+	return seq, nil
+}
+
+// advance updates seq for stream that was already persisted by store
+func (r *replicationState) advance(streamName string, seq uint64) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if old, found := r.seq[streamName]; found && seq <= old {
+		return old
 	}
 
-	return seq, nil
+	r.seq[streamName] = seq
+	return seq
+}
+
+// lookup returns seq for stream and whether there is any
+func (r *replicationState) lookup(streamName string) (uint64, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	seq, found := r.seq[streamName]
+	return seq, found
 }
 
 func (r *replicationState) get(streamName string) uint64 {
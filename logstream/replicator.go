@@ -4,201 +4,514 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/maxpert/marmot/stream"
 
-	"github.com/klauspost/compress/zstd"
 	"github.com/maxpert/marmot/cfg"
 	"github.com/maxpert/marmot/snapshot"
+	"github.com/maxpert/marmot/telemetry"
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 )
 
 const maxReplicateRetries = 7
+const publishAckTimeout = 30 * time.Second
+const applyBatchWait = 10 * time.Millisecond
 const SnapshotShardID = uint64(1)
 
+// Room left in maximum payload for headers of published entries
+const publishHeaderAllowance = 512
+
+var ErrPayloadTooLarge = errors.New("payload exceeds maximum payload size")
+
 var SnapshotLeaseTTL = 10 * time.Second
 
 type Replicator struct {
-	nodeID             uint64
-	shards             uint64
-	compressionEnabled bool
-	lastSnapshot       time.Time
+	nodeID       uint64
+	lastSnapshot time.Time
+	codec        *payloadCodec
 
 	client    *nats.Conn
 	repState  *replicationState
 	metaStore *replicatorMetaStore
 	snapshot  snapshot.NatsSnapshot
-	streamMap map[uint64]nats.JetStreamContext
+
+	// Publish batches hold read lock while in flight, layout is switched under write lock
+	layoutLock *sync.RWMutex
+	layout     *shardSet
+	previous   *shardSet
+
+	// Stream sequences up to which own changes are replayed, set before listening starts
+	replayUntil map[string]uint64
+
+	duplicates   telemetry.Counter
+	deadLettered telemetry.Counter
+	echoSkipped  telemetry.Counter
 }
 
 func NewReplicator(
 	snapshot snapshot.NatsSnapshot,
+	stateStore ReplicationStateStore,
 ) (*Replicator, error) {
 	nodeID := cfg.Config.NodeID
-	shards := cfg.Config.ReplicationLog.Shards
-	compress := cfg.Config.ReplicationLog.Compress
-	updateExisting := cfg.Config.ReplicationLog.UpdateExisting
-
 	nc, err := stream.Connect()
 	if err != nil {
 		return nil, err
 	}
 
-	streamMap := map[uint64]nats.JetStreamContext{}
-	for i := uint64(0); i < shards; i++ {
-		shard := i + 1
-		js, err := nc.JetStream()
-		if err != nil {
-			return nil, err
-		}
-
-		streamCfg := makeShardStreamConfig(shard, shards, compress)
-		info, err := js.StreamInfo(streamName(shard, compress), nats.MaxWait(10*time.Second))
-		if err == nats.ErrStreamNotFound {
-			log.Debug().Uint64("shard", shard).Msg("Creating stream")
-			info, err = js.AddStream(streamCfg)
-		}
-
-		if err != nil {
-			log.Error().
-				Err(err).
-				Str("name", streamName(shard, compress)).
-				Msg("Unable to get stream info...")
-			return nil, err
-		}
+	metaStore, err := newReplicatorMetaStore(cfg.EmbeddedClusterName, nc)
+	if err != nil {
+		return nil, err
+	}
 
-		if updateExisting && !eqShardStreamConfig(&info.Config, streamCfg) {
-			log.Warn().Msgf("Stream configuration not same for %s, updating...", streamName(shard, compress))
-			info, err = js.UpdateStream(streamCfg)
-			if err != nil {
-				log.Error().
-					Err(err).
-					Str("name", streamName(shard, compress)).
-					Msg("Unable update stream info...")
-				return nil, err
-			}
-		}
+	layout, err := loadShardLayout(metaStore)
+	if err != nil {
+		return nil, err
+	}
 
-		leader := ""
-		if info.Cluster != nil {
-			leader = info.Cluster.Leader
-		}
+	if layout.Shards != cfg.Config.ReplicationLog.Shards {
+		log.Warn().
+			Uint64("shards", layout.Shards).
+			Uint64("configured_shards", cfg.Config.ReplicationLog.Shards).
+			Msg("Cluster shard layout differs from configuration, use -reshard to change it")
+	}
 
-		log.Debug().
-			Uint64("shard", shard).
-			Str("name", info.Config.Name).
-			Int("replicas", info.Config.Replicas).
-			Str("leader", leader).
-			Msg("Stream ready...")
+	current, err := openShardSet(nc, layout.Generation, layout.Shards, layout.CompressedNames)
+	if err != nil {
+		return nil, err
+	}
 
+	var previous *shardSet
+	if layout.PrevShards != 0 {
+		previous, err = attachShardSet(nc, layout.PrevGeneration, layout.PrevShards, layout.CompressedNames)
 		if err != nil {
 			return nil, err
 		}
-
-		streamMap[shard] = js
 	}
 
-	repState := &replicationState{}
-	err = repState.init()
+	codec, err := newPayloadCodec(
+		cfg.Config.ReplicationLog.PayloadCodec(),
+		cfg.Config.ReplicationLog.Dictionaries,
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	metaStore, err := newReplicatorMetaStore(cfg.EmbeddedClusterName, nc)
+	repState := &replicationState{}
+	err = repState.init(stateStore)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Replicator{
-		client:             nc,
-		nodeID:             nodeID,
-		compressionEnabled: compress,
-		lastSnapshot:       time.Time{},
+		client:       nc,
+		nodeID:       nodeID,
+		lastSnapshot: time.Time{},
+		codec:        codec,
 
-		shards:    shards,
-		streamMap: streamMap,
 		snapshot:  snapshot,
 		repState:  repState,
 		metaStore: metaStore,
+
+		layoutLock: &sync.RWMutex{},
+		layout:     current,
+		previous:   previous,
+
+		replayUntil: map[string]uint64{},
+
+		duplicates:   telemetry.NewCounter("publish_duplicates", "number of published entries dropped by stream as duplicates"),
+		deadLettered: telemetry.NewCounter("dead_lettered", "number of replicated entries moved to dead-letter stream"),
+		echoSkipped:  telemetry.NewCounter("echo_skipped", "number of replicated entries skipped for being published by this node"),
 	}, nil
 }
 
-func (r *Replicator) Publish(hash uint64, payload []byte) error {
-	shardID := (hash % r.shards) + 1
-	js, ok := r.streamMap[shardID]
+// PublishBatch publishes payloads asynchronously, at most publish_ack_window payloads are
+// pending acknowledgement at any time. Payloads are ordered same as they were published.
+// Batch pins shard layout until Wait, which must be called even if publishing failed.
+type PublishBatch struct {
+	r       *Replicator
+	set     *shardSet
+	pending []pendingPublish
+	done    bool
+}
+
+type pendingPublish struct {
+	shardID uint64
+	future  nats.PubAckFuture
+}
+
+func (r *Replicator) NewPublishBatch() *PublishBatch {
+	r.layoutLock.RLock()
+	return &PublishBatch{r: r, set: r.layout, pending: make([]pendingPublish, 0)}
+}
+
+// Shards returns number of shards batch publishes to
+func (b *PublishBatch) Shards() uint64 {
+	return b.set.shards
+}
+
+// Publish publishes payload on shard picked by hash, msgID if not empty lets stream drop
+// payloads published again with same ID within dedup_window. Table picks compression dictionary.
+// Payloads that don't fit in maximum payload once encoded fail with ErrPayloadTooLarge.
+func (b *PublishBatch) Publish(hash uint64, msgID string, table string, payload []byte) error {
+	shardID := (hash % b.set.shards) + 1
+	payload, header, err := b.r.codec.encode(table, payload)
+	if err != nil {
+		return err
+	}
+
+	if int64(len(payload)+publishHeaderAllowance) > b.r.client.MaxPayload() {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(payload))
+	}
+
+	return b.publishShard(shardID, msgID, payload, header)
+}
+
+// PublishAll publishes payload on every shard, see Replicator.PublishAll
+func (b *PublishBatch) PublishAll(payload []byte) error {
+	payload, header, err := b.r.codec.encode("", payload)
+	if err != nil {
+		return err
+	}
+
+	for shardID := uint64(1); shardID <= b.set.shards; shardID++ {
+		err = b.publishShard(shardID, "", payload, header)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *PublishBatch) publishShard(shardID uint64, msgID string, payload []byte, header nats.Header) error {
+	js, ok := b.set.streams[shardID]
 	if !ok {
 		log.Panic().
 			Uint64("shard", shardID).
 			Msg("Invalid shard")
 	}
 
-	if r.compressionEnabled {
-		compPayload, err := payloadCompress(payload)
-		if err != nil {
-			return err
+	opts := make([]nats.PubOpt, 0, 1)
+	if msgID != "" {
+		opts = append(opts, nats.MsgId(msgID))
+	}
+
+	msg := nats.NewMsg(b.set.subjectName(shardID))
+	msg.Data = payload
+	for key := range header {
+		msg.Header.Set(key, header.Get(key))
+	}
+	future, err := js.PublishMsgAsync(msg, opts...)
+	if err != nil {
+		return err
+	}
+
+	b.pending = append(b.pending, pendingPublish{shardID: shardID, future: future})
+	return nil
+}
+
+// Wait collects acknowledgements of all published payloads, returning first error if any
+func (b *PublishBatch) Wait() error {
+	var firstErr error
+	for _, p := range b.pending {
+		var err error
+		select {
+		case ack := <-p.future.Ok():
+			b.r.onPublished(b.set, p.shardID, ack)
+		case err = <-p.future.Err():
+		case <-time.After(publishAckTimeout):
+			err = nats.ErrTimeout
 		}
 
-		payload = compPayload
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	b.pending = b.pending[:0]
+	if !b.done {
+		b.done = true
+		b.r.layoutLock.RUnlock()
 	}
 
-	ack, err := js.Publish(subjectName(shardID), payload)
+	return firstErr
+}
+
+// onPublished triggers snapshot every max_entries published entries, applied sequence is only
+// ever saved by listener along with applied entries
+func (r *Replicator) onPublished(set *shardSet, shardID uint64, ack *nats.PubAck) {
+	if ack.Duplicate {
+		r.duplicates.Inc()
+		log.Debug().
+			Uint64("seq", ack.Sequence).
+			Str("stream", ack.Stream).
+			Msg("Published entry was a duplicate")
+		return
+	}
+
+	snapshotEntries := uint64(cfg.Config.ReplicationLog.MaxEntries) / set.shards
+	if !cfg.Config.Snapshot.Enable || snapshotEntries == 0 || shardID != SnapshotShardID {
+		return
+	}
+
+	if ack.Sequence%snapshotEntries == 0 {
+		log.Debug().
+			Uint64("seq", ack.Sequence).
+			Str("stream", ack.Stream).
+			Msg("Initiating save snapshot")
+		go r.SaveSnapshot()
+	}
+}
+
+// ReplicationEntry is payload of replicated entry along with stream sequence it was received at
+type ReplicationEntry struct {
+	Seq     uint64
+	Payload []byte
+}
+
+// ReplicationListener applies entries, seq is stream sequence of last received entry which listener
+// is expected to persist atomically with applied entries
+type ReplicationListener func(streamName string, seq uint64, entries []ReplicationEntry) error
+
+// Listen applies replication log with callback until it's canceled or fails. After resharding
+// listening moves to streams of new layout once everything published on replaced ones is applied.
+func (r *Replicator) Listen(callback ReplicationListener) error {
+	watcher, err := r.metaStore.Watch(shardLayoutKey)
 	if err != nil {
 		return err
 	}
+	defer watcher.Stop()
 
-	if cfg.Config.Snapshot.Enable {
-		seq, err := r.repState.save(ack.Stream, ack.Sequence)
-		if err != nil {
-			return err
-		}
+	r.layoutLock.RLock()
+	current, previous := r.layout, r.previous
+	r.layoutLock.RUnlock()
 
-		snapshotEntries := uint64(cfg.Config.ReplicationLog.MaxEntries) / r.shards
-		if snapshotEntries != 0 && seq%snapshotEntries == 0 && shardID == SnapshotShardID {
-			log.Debug().
-				Uint64("seq", seq).
-				Str("stream", ack.Stream).
-				Msg("Initiating save snapshot")
-			go r.SaveSnapshot()
+	errChan := make(chan error)
+	running := 0
+	if previous != nil {
+		running += r.listenShardSet(previous, nil, callback, errChan)
+	}
+	running += r.listenShardSet(current, previous, callback, errChan)
+
+	updates := watcher.Updates()
+	for running > 0 {
+		select {
+		case err = <-errChan:
+			running--
+			if err != nil {
+				return err
+			}
+		case entry, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+
+			// Nil entry marks end of initial values
+			if entry == nil {
+				continue
+			}
+
+			layout := &ShardLayout{}
+			err = layout.DeserializeFrom(entry.Value())
+			if err != nil {
+				return err
+			}
+
+			next, replaced, err := r.switchLayout(layout)
+			if err != nil {
+				return err
+			}
+
+			if next != nil {
+				running += r.listenShardSet(next, replaced, callback, errChan)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error) error {
-	js := r.streamMap[shardID]
+// listenShardSet listens on every shard of set once after is drained, set is drained
+// when all of its listeners are done. It returns number of started listeners.
+func (r *Replicator) listenShardSet(
+	set *shardSet,
+	after *shardSet,
+	callback ReplicationListener,
+	errChan chan<- error,
+) int {
+	wg := &sync.WaitGroup{}
+	wg.Add(len(set.streams))
+	for shardID := range set.streams {
+		go func(shardID uint64) {
+			if after != nil {
+				<-after.drained
+
+				// Marks that node drained previous layout into this one
+				_, err := r.repState.save(set.streamName(shardID), 0)
+				if err != nil {
+					wg.Done()
+					errChan <- err
+					return
+				}
+			}
+
+			log.Debug().
+				Uint64("shard", shardID).
+				Uint64("generation", set.generation).
+				Msg("Listening stream")
+			err := r.listenShard(set, shardID, callback)
+			wg.Done()
+			errChan <- err
+		}(shardID)
+	}
+
+	go func() {
+		wg.Wait()
+		close(set.drained)
+	}()
+
+	return len(set.streams)
+}
+
+// switchLayout moves publishing to streams of newer layout once batches in flight are done, and
+// acknowledges switch to coordinator. It returns new and replaced sets, nils if layout isn't newer.
+func (r *Replicator) switchLayout(layout *ShardLayout) (*shardSet, *shardSet, error) {
+	current := r.currentSet()
+	if layout.Generation <= current.generation {
+		return nil, nil, nil
+	}
+
+	next, err := openShardSet(r.client, layout.Generation, layout.Shards, layout.CompressedNames)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.layoutLock.Lock()
+	r.layout, r.previous = next, current
+	r.layoutLock.Unlock()
+
+	info := &replicatorLockInfo{NodeID: r.nodeID, Timestamp: time.Now().UnixMilli()}
+	payload, err := info.Serialize()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	sub, err := js.SubscribeSync(subjectName(shardID))
+	_, err = r.metaStore.Put(reshardAckKey(layout.Generation, cfg.Config.NodeName()), payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Info().
+		Uint64("generation", layout.Generation).
+		Uint64("shards", layout.Shards).
+		Msg("Switched to new shard layout")
+	return next, current, nil
+}
+
+func (r *Replicator) currentSet() *shardSet {
+	r.layoutLock.RLock()
+	defer r.layoutLock.RUnlock()
+
+	return r.layout
+}
+
+// isReplaced tells if set is no longer published to
+func (r *Replicator) isReplaced(set *shardSet) bool {
+	return set.generation < r.currentSet().generation
+}
+
+// listenShard pulls up to apply_batch_size messages at a time from node's durable consumer and hands
+// them to callback together, messages are acknowledged once per batch by acking the last one. Listening
+// on replaced set ends once shard is drained.
+func (r *Replicator) listenShard(set *shardSet, shardID uint64, callback ReplicationListener) error {
+	js := set.streams[shardID]
+	batchSize := cfg.Config.ReplicationLog.ApplyBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	strName := set.streamName(shardID)
+	savedSeq := r.repState.get(strName)
+	if r.isReplaced(set) {
+		drained, err := set.isDrained(shardID, savedSeq)
+		if err != nil || drained {
+			return err
+		}
+	}
+
+	name, err := r.ensureConsumer(set, shardID, savedSeq)
+	if err != nil {
+		return err
+	}
+
+	sub, err := js.PullSubscribe(set.subjectName(shardID), name, nats.Bind(strName, name))
 	if err != nil {
 		return err
 	}
 	defer sub.Unsubscribe()
 
-	savedSeq := r.repState.get(streamName(shardID, r.compressionEnabled))
 	for sub.IsValid() {
-		msg, err := sub.NextMsg(5 * time.Second)
+		msgs, err := fetchBatch(sub, batchSize)
 		if errors.Is(err, nats.ErrTimeout) {
-			continue
+			if !r.isReplaced(set) {
+				continue
+			}
+
+			drained, err := set.isDrained(shardID, savedSeq)
+			if err != nil {
+				return err
+			}
+
+			if !drained {
+				continue
+			}
+
+			log.Info().Str("stream", strName).Uint64("seq", savedSeq).Msg("Drained replaced stream")
+			err = js.DeleteConsumer(strName, name)
+			if err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+				log.Warn().Err(err).Str("name", name).Msg("Unable to remove consumer of drained stream")
+			}
+
+			return nil
 		}
 
-		if err != nil {
-			return err
+		// Drained streams of replaced set are removed, possibly before this node noticed the switch
+		if errors.Is(err, nats.ErrConsumerDeleted) && r.waitReplaced(set) {
+			log.Info().Str("stream", strName).Uint64("seq", savedSeq).Msg("Replaced stream was removed once drained")
+			return nil
 		}
 
-		meta, err := msg.Metadata()
 		if err != nil {
 			return err
 		}
 
-		if meta.Sequence.Stream <= savedSeq {
-			continue
+		// Messages delivered but not acknowledged before restart are redelivered
+		pending := make([]*nats.Msg, 0, len(msgs))
+		lastSeq := savedSeq
+		for _, msg := range msgs {
+			meta, err := msg.Metadata()
+			if err != nil {
+				return err
+			}
+
+			if meta.Sequence.Stream <= savedSeq {
+				continue
+			}
+
+			pending = append(pending, msg)
+			lastSeq = meta.Sequence.Stream
 		}
 
-		err = r.invokeListener(callback, msg)
+		err = r.invokeBatchListener(callback, strName, lastSeq, pending)
 		if err != nil {
-			msg.Nak()
+			for _, msg := range pending {
+				msg.Nak()
+			}
+
 			if errors.Is(err, context.Canceled) {
 				return nil
 			}
@@ -207,18 +520,163 @@ func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error)
 			return err
 		}
 
-		savedSeq, err = r.repState.save(meta.Stream, meta.Sequence.Stream)
+		savedSeq = r.repState.advance(strName, lastSeq)
+
+		err = msgs[len(msgs)-1].Ack()
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// waitReplaced waits up to ReshardTimeout for set to be replaced by newer layout
+func (r *Replicator) waitReplaced(set *shardSet) bool {
+	deadline := time.Now().Add(ReshardTimeout)
+	for !r.isReplaced(set) {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(reshardPollInterval)
+	}
 
-		err = msg.Ack()
+	return true
+}
+
+// ensureConsumer makes sure node's durable consumer for shard delivers right after savedSeq. Existing
+// consumer is reused if everything up to savedSeq was acknowledged, otherwise it's recreated.
+func (r *Replicator) ensureConsumer(set *shardSet, shardID uint64, savedSeq uint64) (string, error) {
+	js := set.streams[shardID]
+	strName := set.streamName(shardID)
+	consumerCfg := makeShardConsumerConfig(set.generation, shardID, savedSeq)
+
+	info, err := js.ConsumerInfo(strName, consumerCfg.Durable)
+	if err == nil {
+		if info.AckFloor.Stream == savedSeq && eqShardConsumerConfig(&info.Config, consumerCfg) {
+			return consumerCfg.Durable, nil
+		}
+
+		log.Info().
+			Str("name", consumerCfg.Durable).
+			Uint64("ack_floor", info.AckFloor.Stream).
+			Uint64("saved_seq", savedSeq).
+			Msg("Consumer out of sync with replication state, recreating...")
+
+		err = js.DeleteConsumer(strName, consumerCfg.Durable)
+	}
+
+	if err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+		return "", err
+	}
+
+	_, err = js.AddConsumer(strName, consumerCfg)
+	if err != nil {
+		return "", err
+	}
+
+	return consumerCfg.Durable, nil
+}
+
+// fetchBatch waits for next message, then takes whatever else is readily available up to batchSize
+func fetchBatch(sub *nats.Subscription, batchSize int) ([]*nats.Msg, error) {
+	msgs, err := sub.Fetch(1, nats.MaxWait(5*time.Second))
+	if err != nil || batchSize < 2 {
+		return msgs, err
+	}
+
+	more, err := sub.Fetch(batchSize-1, nats.MaxWait(applyBatchWait))
+	if err != nil && !errors.Is(err, nats.ErrTimeout) {
+		return nil, err
+	}
+
+	return append(msgs, more...), nil
+}
+
+// invokeBatchListener applies msgs with a single callback, if that fails messages are applied one
+// by one with retries, so that only failing message stops replication or is dead-lettered. Messages
+// published by this node are skipped, but lastSeq is still recorded.
+func (r *Replicator) invokeBatchListener(
+	callback ReplicationListener,
+	strName string,
+	lastSeq uint64,
+	msgs []*nats.Msg,
+) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	pending := make([]*nats.Msg, 0, len(msgs))
+	entries := make([]ReplicationEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		meta, err := msg.Metadata()
 		if err != nil {
 			return err
 		}
+
+		// Payloads failing to decode are left for callback to fail on
+		payload, err := r.decodePayload(msg)
+		if err == nil && r.isEcho(strName, meta.Sequence.Stream, payload) {
+			r.echoSkipped.Inc()
+			continue
+		}
+
+		pending = append(pending, msg)
+		entries = append(entries, ReplicationEntry{Seq: meta.Sequence.Stream, Payload: payload})
 	}
 
-	return nil
+	if len(pending) == 0 {
+		return callback(strName, lastSeq, nil)
+	}
+
+	if len(pending) > 1 {
+		err := callback(strName, lastSeq, entries)
+		if err == nil || errors.Is(err, context.Canceled) {
+			return err
+		}
+
+		log.Warn().
+			Err(err).
+			Int("size", len(pending)).
+			Msg("Unable to apply batch, applying messages one by one")
+	}
+
+	for _, msg := range pending {
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+
+		err = r.invokeListener(callback, strName, meta.Sequence.Stream, msg)
+		if err != nil && !errors.Is(err, context.Canceled) &&
+			cfg.Config.ReplicationLog.FailurePolicy == cfg.DeadLetterOnFailure {
+			err = r.deadLetter(strName, meta.Sequence.Stream, msg, err)
+			if err == nil {
+				_, err = r.repState.save(strName, meta.Sequence.Stream)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		r.repState.advance(strName, meta.Sequence.Stream)
+	}
+
+	// Batch might end with skipped messages
+	_, err := r.repState.save(strName, lastSeq)
+	return err
+}
+
+// isEcho tells if payload was published by this node, such changes are part of local database
+// already, unless it was restored from a snapshot taken before they were published
+func (r *Replicator) isEcho(strName string, seq uint64, payload []byte) bool {
+	if seq <= r.replayUntil[strName] {
+		return false
+	}
+
+	return originNodeID(payload) == r.nodeID
 }
 
 func (r *Replicator) RestoreSnapshot() error {
@@ -226,27 +684,108 @@ func (r *Replicator) RestoreSnapshot() error {
 		return nil
 	}
 
-	for shardID, js := range r.streamMap {
-		strName := streamName(shardID, r.compressionEnabled)
-		info, err := js.StreamInfo(strName)
-		if err != nil {
-			return err
+	for _, set := range r.shardSets() {
+		for shardID, js := range set.streams {
+			strName := set.streamName(shardID)
+			info, err := js.StreamInfo(strName)
+			if errors.Is(err, nats.ErrStreamNotFound) && set != r.layout {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if !r.missesEntries(set, strName, info) {
+				continue
+			}
+
+			return r.RestoreSnapshotVersion("")
 		}
+	}
 
-		savedSeq := r.repState.get(strName)
-		if savedSeq < info.State.FirstSeq {
-			return r.snapshot.RestoreSnapshot()
+	return nil
+}
+
+// RestoreSnapshotVersion restores given snapshot version regardless of node missing entries,
+// empty version restores latest valid one
+func (r *Replicator) RestoreSnapshotVersion(version string) error {
+	if r.snapshot == nil {
+		return nil
+	}
+
+	err := r.snapshot.RestoreSnapshot(version)
+	if err != nil {
+		return err
+	}
+
+	// Replication state lives in restored database now
+	err = r.repState.init(r.repState.store)
+	if err != nil {
+		return err
+	}
+
+	return r.markReplayRange()
+}
+
+// missesEntries tells if node can no longer catch up on stream, because entries it hasn't applied
+// were removed or, for streams of resharded layout, it never drained streams of previous layout
+func (r *Replicator) missesEntries(set *shardSet, strName string, info *nats.StreamInfo) bool {
+	savedSeq, found := r.repState.lookup(strName)
+	if found {
+		return savedSeq+1 < info.State.FirstSeq
+	}
+
+	if set.generation == 0 {
+		return info.State.FirstSeq > 0
+	}
+
+	return set != r.layout || r.previous == nil
+}
+
+// markReplayRange makes sure own changes published before restore are applied onto restored
+// database, snapshot might have been taken before they were published
+func (r *Replicator) markReplayRange() error {
+	for _, set := range r.shardSets() {
+		for shardID, js := range set.streams {
+			strName := set.streamName(shardID)
+			info, err := js.StreamInfo(strName)
+			if errors.Is(err, nats.ErrStreamNotFound) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			r.replayUntil[strName] = info.State.LastSeq
 		}
 	}
 
 	return nil
 }
 
+// shardSets returns replaced set still being drained if any, followed by current set
+func (r *Replicator) shardSets() []*shardSet {
+	r.layoutLock.RLock()
+	defer r.layoutLock.RUnlock()
+
+	if r.previous == nil {
+		return []*shardSet{r.layout}
+	}
+
+	return []*shardSet{r.previous, r.layout}
+}
+
 func (r *Replicator) LastSaveSnapshotTime() time.Time {
 	return r.lastSnapshot
 }
 
 func (r *Replicator) SaveSnapshot() {
+	if r.snapshot == nil {
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -261,14 +800,38 @@ func (r *Replicator) SaveSnapshot() {
 		return
 	}
 
-	r.ForceSaveSnapshot()
+	r.saveSnapshot()
 }
 
+// ForceSaveSnapshot saves snapshot even if another node is saving one, it waits for that node
+// to finish since retention of one save may remove chunks another one is about to reference
 func (r *Replicator) ForceSaveSnapshot() {
 	if r.snapshot == nil {
 		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for {
+		locked, err := r.metaStore.ContextRefreshingLease("snapshot", SnapshotLeaseTTL, ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("Error acquiring snapshot lock")
+			return
+		}
+
+		if locked {
+			break
+		}
+
+		log.Info().Msg("Snapshot saving locked by another node, waiting")
+		time.Sleep(SnapshotLeaseTTL / 2)
+	}
+
+	r.saveSnapshot()
+}
+
+func (r *Replicator) saveSnapshot() {
 	err := r.snapshot.SaveSnapshot()
 	if err != nil {
 		log.Error().
@@ -298,15 +861,10 @@ func (r *Replicator) ReloadCertificates() error {
 	return nil
 }
 
-func (r *Replicator) invokeListener(callback func(payload []byte) error, msg *nats.Msg) error {
-	var err error
-	payload := msg.Data
-
-	if r.compressionEnabled {
-		payload, err = payloadDecompress(msg.Data)
-		if err != nil {
-			return err
-		}
+func (r *Replicator) invokeListener(callback ReplicationListener, strName string, seq uint64, msg *nats.Msg) error {
+	payload, err := r.decodePayload(msg)
+	if err != nil {
+		return err
 	}
 
 	for repRetry := 0; repRetry < maxReplicateRetries; repRetry++ {
@@ -318,7 +876,7 @@ func (r *Replicator) invokeListener(callback func(payload []byte) error, msg *na
 			}
 		}
 
-		err = callback(payload)
+		err = callback(strName, seq, []ReplicationEntry{{Seq: seq, Payload: payload}})
 		if err == context.Canceled {
 			return err
 		}
@@ -336,8 +894,12 @@ func (r *Replicator) invokeListener(callback func(payload []byte) error, msg *na
 	return err
 }
 
-func makeShardStreamConfig(shardID uint64, totalShards uint64, compressed bool) *nats.StreamConfig {
-	streamName := streamName(shardID, compressed)
+func (r *Replicator) decodePayload(msg *nats.Msg) ([]byte, error) {
+	return r.codec.decode(msg)
+}
+
+func makeShardStreamConfig(generation uint64, shardID uint64, totalShards uint64, compressed bool) *nats.StreamConfig {
+	streamName := streamName(generation, shardID, compressed)
 	replicas := cfg.Config.ReplicationLog.Replicas
 	if replicas < 1 {
 		replicas = int(totalShards>>1) + 1
@@ -349,7 +911,7 @@ func makeShardStreamConfig(shardID uint64, totalShards uint64, compressed bool)
 
 	return &nats.StreamConfig{
 		Name:              streamName,
-		Subjects:          []string{subjectName(shardID)},
+		Subjects:          []string{subjectName(generation, shardID)},
 		Discard:           nats.DiscardOld,
 		MaxMsgs:           cfg.Config.ReplicationLog.MaxEntries,
 		Storage:           nats.FileStorage,
@@ -357,12 +919,32 @@ func makeShardStreamConfig(shardID uint64, totalShards uint64, compressed bool)
 		AllowDirect:       true,
 		MaxConsumers:      -1,
 		MaxMsgsPerSubject: -1,
-		Duplicates:        0,
+		Duplicates:        time.Duration(cfg.Config.ReplicationLog.DedupWindow) * time.Millisecond,
 		DenyDelete:        true,
 		Replicas:          replicas,
 	}
 }
 
+func makeShardConsumerConfig(generation uint64, shardID uint64, savedSeq uint64) *nats.ConsumerConfig {
+	return &nats.ConsumerConfig{
+		Durable:       consumerName(shardID),
+		DeliverPolicy: nats.DeliverByStartSequencePolicy,
+		OptStartSeq:   savedSeq + 1,
+		AckPolicy:     nats.AckAllPolicy,
+		AckWait:       time.Duration(cfg.Config.ReplicationLog.AckWait) * time.Millisecond,
+		MaxAckPending: cfg.Config.ReplicationLog.MaxAckPending,
+		FilterSubject: subjectName(generation, shardID),
+	}
+}
+
+func eqShardConsumerConfig(a *nats.ConsumerConfig, b *nats.ConsumerConfig) bool {
+	return a.Durable == b.Durable &&
+		a.AckPolicy == b.AckPolicy &&
+		a.AckWait == b.AckWait &&
+		a.MaxAckPending == b.MaxAckPending &&
+		a.FilterSubject == b.FilterSubject
+}
+
 func eqShardStreamConfig(a *nats.StreamConfig, b *nats.StreamConfig) bool {
 	return a.Name == b.Name &&
 		len(a.Subjects) == 1 &&
@@ -380,7 +962,13 @@ func eqShardStreamConfig(a *nats.StreamConfig, b *nats.StreamConfig) bool {
 		a.Replicas == b.Replicas
 }
 
-func streamName(shardID uint64, compressed bool) string {
+// streamName of shard in layout generation, streams of initial layout carry no generation but
+// carry -c suffix if they were named after compression by older versions
+func streamName(generation uint64, shardID uint64, compressed bool) string {
+	if generation != 0 {
+		return fmt.Sprintf("%s-g%d-%d", cfg.Config.NATS.StreamPrefix, generation, shardID)
+	}
+
 	compPostfix := ""
 	if compressed {
 		compPostfix = "-c"
@@ -389,24 +977,14 @@ func streamName(shardID uint64, compressed bool) string {
 	return fmt.Sprintf("%s%s-%d", cfg.Config.NATS.StreamPrefix, compPostfix, shardID)
 }
 
-func subjectName(shardID uint64) string {
-	return fmt.Sprintf("%s-%d", cfg.Config.NATS.SubjectPrefix, shardID)
-}
-
-func payloadCompress(payload []byte) ([]byte, error) {
-	enc, err := zstd.NewWriter(nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return enc.EncodeAll(payload, nil), nil
+func consumerName(shardID uint64) string {
+	return fmt.Sprintf("%s-%d", cfg.Config.NodeName(), shardID)
 }
 
-func payloadDecompress(payload []byte) ([]byte, error) {
-	dec, err := zstd.NewReader(nil)
-	if err != nil {
-		return nil, err
+func subjectName(generation uint64, shardID uint64) string {
+	if generation == 0 {
+		return fmt.Sprintf("%s-%d", cfg.Config.NATS.SubjectPrefix, shardID)
 	}
 
-	return dec.DecodeAll(payload, nil)
+	return fmt.Sprintf("%s-g%d-%d", cfg.Config.NATS.SubjectPrefix, generation, shardID)
 }
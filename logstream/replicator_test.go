@@ -0,0 +1,398 @@
+package logstream
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+	"github.com/maxpert/marmot/db"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+const testNodeID = 1
+
+// memStateStore keeps sequences in memory in place of database
+type memStateStore struct {
+	lock *sync.Mutex
+	seq  map[string]uint64
+}
+
+func newMemStateStore() *memStateStore {
+	return &memStateStore{lock: &sync.Mutex{}, seq: map[string]uint64{}}
+}
+
+func (s *memStateStore) LoadSequences() (map[string]uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := make(map[string]uint64, len(s.seq))
+	for k, v := range s.seq {
+		ret[k] = v
+	}
+
+	return ret, nil
+}
+
+func (s *memStateStore) SaveSequence(streamName string, seq uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if seq > s.seq[streamName] {
+		s.seq[streamName] = seq
+	}
+
+	return nil
+}
+
+// startTestServer runs JetStream server for duration of test and points configuration at it
+func startTestServer(t *testing.T) {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoSigs:    true,
+		NoLog:     true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	saved := cfg.Config
+	copied := *saved
+	cfg.Config = &copied
+	t.Cleanup(func() { cfg.Config = saved })
+
+	cfg.Config.NodeID = testNodeID
+	cfg.Config.SeqMapPath = path.Join(t.TempDir(), "seq-map.cbor")
+	cfg.Config.Snapshot.Enable = false
+	cfg.Config.NATS.URLs = []string{s.ClientURL()}
+	cfg.Config.ReplicationLog.Shards = 1
+	cfg.Config.ReplicationLog.Replicas = 1
+	cfg.Config.ReplicationLog.ApplyBatchSize = 1
+}
+
+func newTestReplicator(t *testing.T, store ReplicationStateStore) *Replicator {
+	r, err := NewReplicator(nil, store)
+	if err != nil {
+		t.Fatalf("NewReplicator() error = %v", err)
+	}
+
+	t.Cleanup(r.client.Close)
+	return r
+}
+
+// testEntry makes replication event payload of node carrying body
+func testEntry(t *testing.T, nodeID uint64, body string) []byte {
+	em, err := cbor.EncOptions{}.EncModeWithTags(core.CBORTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := em.Marshal(body)
+	if err == nil {
+		payload, err = em.Marshal(encodedReplicationEvent{FromNodeId: nodeID, Payload: payload})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return payload
+}
+
+func entryBody(t *testing.T, payload []byte) string {
+	ev := encodedReplicationEvent{}
+	body := ""
+	err := cbor.Unmarshal(payload, &ev)
+	if err == nil {
+		err = cbor.Unmarshal(ev.Payload, &body)
+	}
+
+	if err != nil {
+		t.Fatalf("decoding entry: %v", err)
+	}
+
+	return body
+}
+
+// publishTestEntries publishes bodies as entries of another node in a single batch
+func publishTestEntries(t *testing.T, r *Replicator, bodies ...string) {
+	batch := r.NewPublishBatch()
+	for _, body := range bodies {
+		err := batch.Publish(0, "", "", testEntry(t, testNodeID+1, body))
+		if err != nil {
+			batch.Wait()
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+
+	if err := batch.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+}
+
+// listenUntil listens applying entries with apply, saving sequences of applied ones, until it
+// receives entry with given body which is left unapplied
+func listenUntil(
+	t *testing.T,
+	r *Replicator,
+	store ReplicationStateStore,
+	until string,
+	apply func(body string) error,
+) []string {
+	applied := make([]string, 0)
+	done := make(chan error)
+	go func() {
+		done <- r.Listen(func(streamName string, seq uint64, entries []ReplicationEntry) error {
+			for _, entry := range entries {
+				body := entryBody(t, entry.Payload)
+				if body == until {
+					return context.Canceled
+				}
+
+				if err := apply(body); err != nil {
+					return err
+				}
+
+				applied = append(applied, body)
+			}
+
+			return store.SaveSequence(streamName, seq)
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Listen() didn't receive %s, applied %v", until, applied)
+	}
+
+	return applied
+}
+
+func applyAll(string) error {
+	return nil
+}
+
+func TestPublishListenRoundTrip(t *testing.T) {
+	startTestServer(t)
+	store := newMemStateStore()
+	r := newTestReplicator(t, store)
+
+	// Own entries are part of local database already
+	publishTestEntries(t, r, "a", "b")
+	batch := r.NewPublishBatch()
+	if err := batch.Publish(0, "", "", testEntry(t, testNodeID, "own")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := batch.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	publishTestEntries(t, r, "c", "stop")
+	if got := listenUntil(t, r, store, "stop", applyAll); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("applied %v, want [a b c]", got)
+	}
+
+	// Restarted node resumes after saved sequence, starting with entry left unapplied
+	r = newTestReplicator(t, store)
+	publishTestEntries(t, r, "d", "stop again")
+	got := listenUntil(t, r, store, "stop again", applyAll)
+	if !reflect.DeepEqual(got, []string{"stop", "d"}) {
+		t.Errorf("applied %v after resuming, want [stop d]", got)
+	}
+
+	seq, _ := store.LoadSequences()
+	if want := map[string]uint64{r.currentSet().streamName(1): 6}; !reflect.DeepEqual(seq, want) {
+		t.Errorf("saved sequences = %v, want %v", seq, want)
+	}
+}
+
+func TestPublishBatchDeduplicatesMessageIDs(t *testing.T) {
+	startTestServer(t)
+	store := newMemStateStore()
+	r := newTestReplicator(t, store)
+
+	batch := r.NewPublishBatch()
+	for _, body := range []string{"a", "a", "b"} {
+		if err := batch.Publish(0, "id-"+body, "", testEntry(t, testNodeID+1, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := batch.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	publishTestEntries(t, r, "stop")
+	if got := listenUntil(t, r, store, "stop", applyAll); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("applied %v, want [a b]", got)
+	}
+}
+
+// openTestStreamDB creates database of orders and their items
+func openTestStreamDB(t *testing.T) (*db.SqliteStreamDB, *sql.DB) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+	raw, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+
+	_, err = raw.Exec(`
+		CREATE TABLE orders (id INTEGER PRIMARY KEY, total INTEGER);
+		CREATE TABLE items (id INTEGER PRIMARY KEY, order_id INTEGER, qty INTEGER);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamDB, err := db.OpenStreamDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenStreamDB() error = %v", err)
+	}
+
+	return streamDB, raw
+}
+
+func TestCommitGroupRoundTrip(t *testing.T) {
+	startTestServer(t)
+	store := newMemStateStore()
+	r := newTestReplicator(t, store)
+	tables := []string{"orders", "items"}
+
+	// Source node publishes its commit groups the way it's done in production
+	source, sourceRaw := openTestStreamDB(t)
+	published := make(chan int, 10)
+	source.OnChange = func(txs []*db.ChangeLogTransaction) error {
+		batch := r.NewPublishBatch()
+		for _, tx := range txs {
+			ev := &ReplicationEvent[db.ChangeLogTransaction]{FromNodeId: testNodeID + 1, Payload: *tx}
+			data, err := ev.Marshal()
+			if err != nil {
+				batch.Wait()
+				return err
+			}
+
+			hash, err := tx.Hash()
+			if err == nil {
+				err = batch.Publish(hash, tx.MessageID(testNodeID+1), tx.Events[0].TableName, data)
+			}
+
+			if err != nil {
+				batch.Wait()
+				return err
+			}
+
+			published <- len(tx.Events)
+		}
+
+		return batch.Wait()
+	}
+
+	if err := source.InstallCDC(tables); err != nil {
+		t.Fatalf("InstallCDC() error = %v", err)
+	}
+
+	tx, err := sourceRaw.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range []string{
+		"INSERT INTO orders VALUES (1, 5)",
+		"INSERT INTO items VALUES (1, 1, 2)",
+		"INSERT INTO items VALUES (2, 1, 3)",
+	} {
+		if _, err = tx.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-published:
+		if n != 3 {
+			t.Errorf("published commit group of %d changes, want 3", n)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("commit group wasn't published")
+	}
+
+	publishTestEntries(t, r, "stop")
+
+	// Receiving node applies every entry in a database transaction of its own
+	dest, destRaw := openTestStreamDB(t)
+	dest.OnChange = func([]*db.ChangeLogTransaction) error { return db.ErrLogNotReadyToPublish }
+	if err = dest.InstallCDC(tables); err != nil {
+		t.Fatalf("InstallCDC() error = %v", err)
+	}
+
+	if _, err = dest.LoadSequences(); err != nil {
+		t.Fatalf("LoadSequences() error = %v", err)
+	}
+
+	entries := 0
+	err = r.Listen(func(streamName string, seq uint64, batch []ReplicationEntry) error {
+		txs := make([]*db.ChangeLogTransaction, 0, len(batch))
+		for _, entry := range batch {
+			ev := &ReplicationEvent[db.ChangeLogTransaction]{}
+			if err := ev.Unmarshal(entry.Payload); err != nil || ev.Payload.IsEmpty() {
+				return context.Canceled
+			}
+
+			txs = append(txs, &ev.Payload)
+		}
+
+		entries += len(txs)
+		return dest.ReplicateBatch(txs, &db.StreamPosition{Stream: streamName, Seq: seq})
+	})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	if entries != 1 {
+		t.Errorf("received %d entries, want commit group as 1", entries)
+	}
+
+	got := make([]int, 0)
+	rows, err := destRaw.Query("SELECT (SELECT COUNT(*) FROM orders), (SELECT SUM(qty) FROM items)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		orders, qty := 0, 0
+		if err = rows.Scan(&orders, &qty); err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, orders, qty)
+	}
+
+	if !reflect.DeepEqual(got, []int{1, 5}) {
+		t.Errorf("replicated orders and item quantity = %v, want [1 5]", got)
+	}
+}
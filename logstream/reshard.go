@@ -0,0 +1,318 @@
+package logstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const reshardPollInterval = 500 * time.Millisecond
+
+var ReshardTimeout = time.Minute
+
+var ErrReshardLocked = errors.New("resharding already in progress")
+var ErrReshardDraining = errors.New("streams of previous shard layout are still being drained")
+var ErrReshardNotSwitched = errors.New("running nodes have not switched to new shard layout")
+
+// Reshard moves replication log to given number of shards. Streams of new layout are created and
+// layout is published through meta store, every running node then switches publishing to new streams
+// and acknowledges it. Old streams are sealed once every running node switched, and nodes apply what's
+// left in them before moving on to new streams. Old streams are removed once every consumer drained
+// them. If either takes longer than ReshardTimeout running Reshard again finishes it.
+func (r *Replicator) Reshard(shards uint64) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	locked, err := r.metaStore.ContextRefreshingLease("reshard", SnapshotLeaseTTL, ctx)
+	if err != nil {
+		return err
+	}
+
+	if !locked {
+		return ErrReshardLocked
+	}
+
+	layout, rev, err := r.metaStore.ShardLayout()
+	if err != nil {
+		return err
+	}
+
+	if layout.PrevShards != 0 {
+		rev, err = r.finishReshard(layout, rev)
+		if err != nil {
+			return err
+		}
+	}
+
+	if layout.Shards == shards {
+		log.Info().Uint64("shards", shards).Msg("Replication log already has requested number of shards")
+		return nil
+	}
+
+	current, err := attachShardSet(r.client, layout.Generation, layout.Shards, layout.CompressedNames)
+	if err != nil {
+		return err
+	}
+
+	next, err := openShardSet(r.client, layout.Generation+1, shards, layout.CompressedNames)
+	if err != nil {
+		return err
+	}
+
+	nextLayout := &ShardLayout{
+		Generation:     next.generation,
+		Shards:         next.shards,
+		PrevGeneration: current.generation,
+		PrevShards:     current.shards,
+
+		CompressedNames: layout.CompressedNames,
+	}
+	rev, err = r.metaStore.UpdateShardLayout(nextLayout, rev)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Uint64("generation", nextLayout.Generation).
+		Uint64("shards", nextLayout.Shards).
+		Msg("Published new shard layout, waiting for nodes to switch...")
+	err = r.waitSwitched(nextLayout.Generation, current)
+	if err != nil {
+		return err
+	}
+
+	err = r.sealShardSet(current)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msg("Sealed streams of previous shard layout, waiting for nodes to drain them...")
+	deadline := time.Now().Add(ReshardTimeout)
+	for {
+		_, err = r.finishReshard(nextLayout, rev)
+		if !errors.Is(err, ErrReshardDraining) || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(reshardPollInterval)
+	}
+
+	if errors.Is(err, ErrReshardDraining) {
+		log.Warn().Msg("Streams of previous shard layout not drained yet, reshard again to remove them once nodes caught up")
+		return nil
+	}
+
+	return err
+}
+
+// finishReshard removes streams of previous layout once every consumer drained them, and
+// clears previous layout. Streams are sealed first in case resharding was interrupted.
+func (r *Replicator) finishReshard(layout *ShardLayout, rev uint64) (uint64, error) {
+	prev, err := attachShardSet(r.client, layout.PrevGeneration, layout.PrevShards, layout.CompressedNames)
+	if err != nil {
+		return 0, err
+	}
+
+	err = r.waitSwitched(layout.Generation, prev)
+	if err != nil {
+		return 0, err
+	}
+
+	err = r.sealShardSet(prev)
+	if err != nil {
+		return 0, err
+	}
+
+	drained, err := r.isShardSetDrained(prev)
+	if err != nil {
+		return 0, err
+	}
+
+	if !drained {
+		return 0, ErrReshardDraining
+	}
+
+	for shardID, js := range prev.streams {
+		err = js.DeleteStream(prev.streamName(shardID))
+		if err != nil && !errors.Is(err, nats.ErrStreamNotFound) {
+			return 0, err
+		}
+	}
+
+	log.Info().
+		Uint64("generation", layout.PrevGeneration).
+		Uint64("shards", layout.PrevShards).
+		Msg("Removed streams of previous shard layout")
+
+	layout.PrevGeneration, layout.PrevShards = 0, 0
+	return r.metaStore.UpdateShardLayout(layout, rev)
+}
+
+// shardSetNodes lists names of nodes consuming set, taken from their durable consumers on first shard
+func (r *Replicator) shardSetNodes(set *shardSet) ([]string, error) {
+	shardID := uint64(1)
+	strName := set.streamName(shardID)
+	_, err := set.streams[shardID].StreamInfo(strName)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := fmt.Sprintf("-%d", shardID)
+	nodes := make([]string, 0)
+	for name := range set.streams[shardID].ConsumerNames(strName) {
+		if strings.HasSuffix(name, suffix) {
+			nodes = append(nodes, strings.TrimSuffix(name, suffix))
+		}
+	}
+
+	return nodes, nil
+}
+
+// waitSwitched waits up to ReshardTimeout, or ack wait if longer, for nodes consuming set to acknowledge
+// switching to layout generation. Nodes that aren't running switch once they start again, but running
+// ones could still publish to set, so it fails if any of them hasn't switched. This node isn't running
+// while resharding so it's not waited for.
+func (r *Replicator) waitSwitched(generation uint64, set *shardSet) error {
+	nodes, err := r.shardSetNodes(set)
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if node != cfg.Config.NodeName() {
+			pending[node] = true
+		}
+	}
+
+	// Node busy applying a batch is seen running once it acknowledges it
+	timeout := ReshardTimeout
+	ackWait := time.Duration(cfg.Config.ReplicationLog.AckWait) * time.Millisecond
+	if ackWait > timeout {
+		timeout = ackWait
+	}
+
+	running := make(map[string]bool)
+	since := time.Now()
+	deadline := since.Add(timeout)
+	for len(pending) > 0 {
+		for node := range pending {
+			_, err := r.metaStore.Get(reshardAckKey(generation, node))
+			if err == nil {
+				delete(pending, node)
+			} else if isNodeListening(set, node, since) {
+				running[node] = true
+			}
+		}
+
+		if len(pending) == 0 || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(reshardPollInterval)
+	}
+
+	notSwitched := make([]string, 0)
+	for node := range pending {
+		if running[node] {
+			notSwitched = append(notSwitched, node)
+			continue
+		}
+
+		log.Warn().
+			Str("node", node).
+			Msg("Node did not switch to new shard layout, it will switch once it's running again")
+	}
+
+	if len(notSwitched) > 0 {
+		return fmt.Errorf("%w: %s", ErrReshardNotSwitched, strings.Join(notSwitched, ", "))
+	}
+
+	return nil
+}
+
+// isNodeListening tells if node has been active on its consumer of first shard of set since given time,
+// either waiting on a pull request or receiving or acknowledging entries
+func isNodeListening(set *shardSet, node string, since time.Time) bool {
+	shardID := uint64(1)
+	name := fmt.Sprintf("%s-%d", node, shardID)
+	info, err := set.streams[shardID].ConsumerInfo(set.streamName(shardID), name)
+	if err != nil {
+		return false
+	}
+
+	activeSince := func(seq nats.SequenceInfo) bool {
+		return seq.Last != nil && seq.Last.After(since)
+	}
+
+	return info.NumWaiting > 0 || activeSince(info.Delivered) || activeSince(info.AckFloor)
+}
+
+// sealShardSet seals streams of set, sealed streams reject publishing
+func (r *Replicator) sealShardSet(set *shardSet) error {
+	for shardID, js := range set.streams {
+		info, err := js.StreamInfo(set.streamName(shardID))
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Config.Sealed {
+			continue
+		}
+
+		streamCfg := info.Config
+		streamCfg.Sealed = true
+		_, err = js.UpdateStream(&streamCfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isShardSetDrained tells if every consumer acknowledged everything in streams of sealed set
+func (r *Replicator) isShardSetDrained(set *shardSet) (bool, error) {
+	for shardID, js := range set.streams {
+		strName := set.streamName(shardID)
+		info, err := js.StreamInfo(strName)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if !info.Config.Sealed {
+			return false, nil
+		}
+
+		drained := true
+		for consumer := range js.ConsumersInfo(strName) {
+			if consumer.AckFloor.Stream < info.State.LastSeq {
+				drained = false
+			}
+		}
+
+		if !drained {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
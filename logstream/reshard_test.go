@@ -0,0 +1,202 @@
+package logstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+)
+
+func shortReshardTimeout(t *testing.T) {
+	timeout := ReshardTimeout
+	t.Cleanup(func() { ReshardTimeout = timeout })
+	ReshardTimeout = 2 * time.Second
+	cfg.Config.ReplicationLog.AckWait = 1000
+}
+
+func TestReshardDrainsPreviousLayout(t *testing.T) {
+	startTestServer(t)
+	shortReshardTimeout(t)
+	store := newMemStateStore()
+	r := newTestReplicator(t, store)
+	coordinator := newTestReplicator(t, newMemStateStore())
+	previous := r.currentSet()
+
+	publishTestEntries(t, r, "a", "b")
+
+	lock := &sync.Mutex{}
+	applied := make([]string, 0)
+	appliedCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(applied)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- r.Listen(func(streamName string, seq uint64, entries []ReplicationEntry) error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, entry := range entries {
+				body := entryBody(t, entry.Payload)
+				if body == "stop" {
+					return context.Canceled
+				}
+
+				applied = append(applied, body)
+			}
+
+			return store.SaveSequence(streamName, seq)
+		})
+	}()
+
+	waitFor(t, "entries of previous layout applied", func() bool { return appliedCount() == 2 })
+	err := coordinator.Reshard(2)
+	if err != nil {
+		t.Fatalf("Reshard() error = %v", err)
+	}
+
+	waitFor(t, "listener switched", func() bool { return r.currentSet().generation == 1 })
+
+	// Drained streams of previous layout are removed along with previous layout
+	_, err = previous.streams[1].StreamInfo(previous.streamName(1))
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Errorf("stream of previous layout info error = %v, want %v", err, nats.ErrStreamNotFound)
+	}
+
+	layout, _, err := coordinator.metaStore.ShardLayout()
+	if err != nil || layout.Shards != 2 || layout.PrevShards != 0 {
+		t.Errorf("ShardLayout() = %+v, %v", layout, err)
+	}
+
+	batch := r.NewPublishBatch()
+	for hash := uint64(0); hash < 2; hash++ {
+		err = batch.Publish(hash, "", "", testEntry(t, testNodeID+1, fmt.Sprintf("shard %d", hash+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = batch.PublishAll(testEntry(t, testNodeID+1, "stop"))
+	if err == nil {
+		err = batch.Wait()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Listen() didn't stop")
+	}
+
+	sort.Strings(applied)
+	if fmt.Sprint(applied) != "[a b shard 1 shard 2]" {
+		t.Errorf("applied %v, want [a b shard 1 shard 2]", applied)
+	}
+}
+
+func TestWaitSwitchedNodeLiveness(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    func(t *testing.T, r *Replicator, sub *nats.Subscription)
+		wantErr error
+	}{
+		{
+			name: "switched node",
+			node: func(t *testing.T, r *Replicator, _ *nats.Subscription) {
+				_, err := r.metaStore.Put(reshardAckKey(1, otherTestNode), []byte{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "stopped node",
+			node: func(*testing.T, *Replicator, *nats.Subscription) {},
+		},
+		{
+			name: "node waiting for entries",
+			node: func(_ *testing.T, _ *Replicator, sub *nats.Subscription) {
+				go sub.Fetch(1, nats.MaxWait(5*time.Second))
+			},
+			wantErr: ErrReshardNotSwitched,
+		},
+		{
+			name: "node busy applying entries",
+			node: func(t *testing.T, r *Replicator, sub *nats.Subscription) {
+				publishTestEntries(t, r, "a")
+				msgs, err := sub.Fetch(1)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Batch is acknowledged once it's applied
+				time.AfterFunc(500*time.Millisecond, func() { msgs[0].Ack() })
+			},
+			wantErr: ErrReshardNotSwitched,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			shortReshardTimeout(t)
+			r := newTestReplicator(t, newMemStateStore())
+			set := r.currentSet()
+			sub := subscribeOtherTestNode(t, set)
+
+			tt.node(t, r, sub)
+			err := r.waitSwitched(1, set)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("waitSwitched() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+var otherTestNode = fmt.Sprintf("%s-%d", cfg.NodeNamePrefix, testNodeID+1)
+
+// subscribeOtherTestNode creates durable consumer of another node on first shard of set
+func subscribeOtherTestNode(t *testing.T, set *shardSet) *nats.Subscription {
+	js := set.streams[1]
+	name := otherTestNode + "-1"
+	_, err := js.AddConsumer(set.streamName(1), &nats.ConsumerConfig{
+		Durable:       name,
+		AckPolicy:     nats.AckAllPolicy,
+		FilterSubject: set.subjectName(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := js.PullSubscribe(set.subjectName(1), name, nats.Bind(set.streamName(1), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sub
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(30 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
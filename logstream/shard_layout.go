@@ -0,0 +1,224 @@
+package logstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const shardLayoutKey = "shard-layout"
+const maxMetaStoreAttempts = 30
+
+// ShardLayout is shard count of replication log shared by cluster through meta store. Generation
+// is bumped by every resharding and is part of stream names, except for initial layout. PrevShards
+// is shard count of previous generation while its streams are drained, zero otherwise. CompressedNames
+// is set when streams of initial layout were named after compression setting by older versions.
+type ShardLayout struct {
+	Generation     uint64
+	Shards         uint64
+	PrevGeneration uint64
+	PrevShards     uint64
+
+	CompressedNames bool
+}
+
+func (l *ShardLayout) Serialize() ([]byte, error) {
+	return cbor.Marshal(l)
+}
+
+func (l *ShardLayout) DeserializeFrom(data []byte) error {
+	return cbor.Unmarshal(data, l)
+}
+
+// shardSet is streams of a single layout generation
+type shardSet struct {
+	generation uint64
+	shards     uint64
+	compressed bool
+	streams    map[uint64]nats.JetStreamContext
+
+	// Closed once node applied everything published on set after it was replaced
+	drained chan struct{}
+}
+
+func (s *shardSet) streamName(shardID uint64) string {
+	return streamName(s.generation, shardID, s.compressed)
+}
+
+func (s *shardSet) subjectName(shardID uint64) string {
+	return subjectName(s.generation, shardID)
+}
+
+// ShardLayout returns layout saved in meta store with its revision, layout from configuration
+// is saved if there is none yet
+func (m *replicatorMetaStore) ShardLayout() (*ShardLayout, uint64, error) {
+	layout := &ShardLayout{}
+	entry, err := m.Get(shardLayoutKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		layout.Shards = cfg.Config.ReplicationLog.Shards
+		layout.CompressedNames = cfg.Config.ReplicationLog.Compress
+		payload, err := layout.Serialize()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rev, err := m.Create(shardLayoutKey, payload)
+		if err == nil {
+			return layout, rev, nil
+		}
+
+		if !errors.Is(err, nats.ErrKeyExists) {
+			return nil, 0, err
+		}
+
+		// Another node saved layout first
+		entry, err = m.Get(shardLayoutKey)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = layout.DeserializeFrom(entry.Value())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return layout, entry.Revision(), nil
+}
+
+// loadShardLayout waits for meta store to come up before reading layout, bucket of a
+// restarted node may take a while to catch up with cluster
+func loadShardLayout(m *replicatorMetaStore) (*ShardLayout, error) {
+	for attempt := 1; ; attempt++ {
+		layout, _, err := m.ShardLayout()
+		if err == nil || attempt >= maxMetaStoreAttempts || !errors.Is(err, context.DeadlineExceeded) {
+			return layout, err
+		}
+
+		log.Debug().Err(err).Msg("Meta store not ready, waiting for it to come up...")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// UpdateShardLayout saves layout unless it was changed since revision rev
+func (m *replicatorMetaStore) UpdateShardLayout(layout *ShardLayout, rev uint64) (uint64, error) {
+	payload, err := layout.Serialize()
+	if err != nil {
+		return 0, err
+	}
+
+	return m.Update(shardLayoutKey, payload, rev)
+}
+
+// openShardSet prepares streams of layout generation, missing streams are created and
+// existing ones are updated if update_existing is set
+func openShardSet(nc *nats.Conn, generation uint64, shards uint64, compressed bool) (*shardSet, error) {
+	updateExisting := cfg.Config.ReplicationLog.UpdateExisting
+	set := &shardSet{
+		generation: generation,
+		shards:     shards,
+		compressed: compressed,
+		streams:    map[uint64]nats.JetStreamContext{},
+		drained:    make(chan struct{}),
+	}
+
+	for i := uint64(0); i < shards; i++ {
+		shard := i + 1
+		js, err := nc.JetStream(nats.PublishAsyncMaxPending(cfg.Config.ReplicationLog.PublishAckWindow))
+		if err != nil {
+			return nil, err
+		}
+
+		streamCfg := makeShardStreamConfig(generation, shard, shards, compressed)
+		info, err := js.StreamInfo(streamCfg.Name, nats.MaxWait(10*time.Second))
+		if err == nats.ErrStreamNotFound {
+			log.Debug().Uint64("shard", shard).Uint64("generation", generation).Msg("Creating stream")
+			info, err = js.AddStream(streamCfg)
+		}
+
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("name", streamCfg.Name).
+				Msg("Unable to get stream info...")
+			return nil, err
+		}
+
+		if updateExisting && !eqShardStreamConfig(&info.Config, streamCfg) {
+			log.Warn().Msgf("Stream configuration not same for %s, updating...", streamCfg.Name)
+			info, err = js.UpdateStream(streamCfg)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("name", streamCfg.Name).
+					Msg("Unable update stream info...")
+				return nil, err
+			}
+		}
+
+		leader := ""
+		if info.Cluster != nil {
+			leader = info.Cluster.Leader
+		}
+
+		log.Debug().
+			Uint64("shard", shard).
+			Str("name", info.Config.Name).
+			Int("replicas", info.Config.Replicas).
+			Str("leader", leader).
+			Msg("Stream ready...")
+
+		set.streams[shard] = js
+	}
+
+	return set, nil
+}
+
+// attachShardSet binds to streams of previous layout generation without creating or updating
+// them, streams might have been removed already
+func attachShardSet(nc *nats.Conn, generation uint64, shards uint64, compressed bool) (*shardSet, error) {
+	set := &shardSet{
+		generation: generation,
+		shards:     shards,
+		compressed: compressed,
+		streams:    map[uint64]nats.JetStreamContext{},
+		drained:    make(chan struct{}),
+	}
+
+	for i := uint64(0); i < shards; i++ {
+		js, err := nc.JetStream()
+		if err != nil {
+			return nil, err
+		}
+
+		set.streams[i+1] = js
+	}
+
+	return set, nil
+}
+
+// isDrained tells if everything published on shard of replaced set was applied, seq being last
+// applied sequence. Streams are sealed once every publisher moved away, so a sealed stream can't grow.
+func (s *shardSet) isDrained(shardID uint64, seq uint64) (bool, error) {
+	info, err := s.streams[shardID].StreamInfo(s.streamName(shardID))
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return info.Config.Sealed && seq >= info.State.LastSeq, nil
+}
+
+func reshardAckKey(generation uint64, nodeName string) string {
+	return fmt.Sprintf("reshard.%d.%s", generation, nodeName)
+}
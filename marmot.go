@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/pprof"
@@ -15,7 +17,9 @@ import (
 
 	"github.com/maxpert/marmot/cfg"
 	"github.com/maxpert/marmot/db"
+	"github.com/maxpert/marmot/encryption"
 	"github.com/maxpert/marmot/logstream"
+	"github.com/maxpert/marmot/signing"
 	"github.com/maxpert/marmot/snapshot"
 
 	"github.com/asaskevich/EventBus"
@@ -46,6 +50,16 @@ func main() {
 		log.Logger = gLog.Level(zerolog.InfoLevel)
 	}
 
+	if *cfg.GenSigningKeyFlag != "" {
+		pub, err := signing.GenerateKey(*cfg.GenSigningKeyFlag)
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to generate signing key")
+		}
+
+		log.Info().Str("public_key", pub).Msg("Generated signing key")
+		return
+	}
+
 	if *cfg.ProfServer != "" {
 		go func() {
 			mux := http.NewServeMux()
@@ -65,6 +79,18 @@ func main() {
 	log.Debug().Msg("Initializing telemetry")
 	telemetry.InitializeTelemetry()
 
+	log.Debug().Msg("Initializing signing")
+	err = signing.Initialize()
+	if err != nil {
+		log.Panic().Err(err).Msg("Unable to load signing keys")
+	}
+
+	log.Debug().Msg("Initializing encryption")
+	err = encryption.Initialize()
+	if err != nil {
+		log.Panic().Err(err).Msg("Unable to load encryption keyring")
+	}
+
 	log.Debug().Str("path", cfg.Config.DBPath).Msg("Opening database")
 	streamDB, err := db.OpenStreamDB(cfg.Config.DBPath)
 	if err != nil {
@@ -83,12 +109,33 @@ func main() {
 		return
 	}
 
+	if *cfg.RequeueFailedFlag {
+		cnt, err := streamDB.RequeueFailedChanges()
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to requeue failed changes...")
+		} else {
+			log.Info().Int64("count", cnt).Msg("Requeued failed changes...")
+		}
+
+		return
+	}
+
 	snpStore, err := snapshot.NewSnapshotStorage()
 	if err != nil {
 		log.Panic().Err(err).Msg("Unable to initialize snapshot storage")
 	}
 
-	replicator, err := logstream.NewReplicator(snapshot.NewNatsDBSnapshot(streamDB, snpStore))
+	dbSnapshot := snapshot.NewNatsDBSnapshot(streamDB, snpStore)
+	if *cfg.ListSnapshotsFlag {
+		err = listSnapshots(dbSnapshot)
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to list snapshots")
+		}
+
+		return
+	}
+
+	replicator, err := logstream.NewReplicator(dbSnapshot, streamDB)
 	if err != nil {
 		log.Panic().Err(err).Msg("Unable to initialize replicators")
 	}
@@ -98,7 +145,21 @@ func main() {
 		return
 	}
 
-	if cfg.Config.Snapshot.Enable && cfg.Config.Replicate {
+	if *cfg.ReshardFlag != 0 {
+		err = replicator.Reshard(*cfg.ReshardFlag)
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to reshard replication log")
+		}
+
+		return
+	}
+
+	if *cfg.RestoreSnapshotFlag != "" {
+		err = replicator.RestoreSnapshotVersion(*cfg.RestoreSnapshotFlag)
+		if err != nil {
+			log.Panic().Err(err).Str("version", *cfg.RestoreSnapshotFlag).Msg("Unable to restore snapshot")
+		}
+	} else if cfg.Config.Snapshot.Enable && cfg.Config.Replicate {
 		err = replicator.RestoreSnapshot()
 		if err != nil {
 			log.Panic().Err(err).Msg("Unable to restore snapshot")
@@ -115,6 +176,21 @@ func main() {
 	eventBus := EventBus.New()
 	ctxSt := utils.NewStateContext()
 
+	// Dead-letter entries are applied without capturing or publishing local changes
+	if *cfg.DeadLetterFlag != "" {
+		err = streamDB.LoadTableSchemas(tableNames)
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to load table schemas")
+		}
+
+		err = manageDeadLetters(replicator, onChangeEvent(streamDB, ctxSt, eventBus))
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to manage dead-letter entries")
+		}
+
+		return
+	}
+
 	streamDB.OnChange = onTableChanged(replicator, ctxSt, eventBus, cfg.Config.NodeID)
 	log.Info().Msg("Starting change data capture pipeline...")
 	if err := streamDB.InstallCDC(tableNames); err != nil {
@@ -123,9 +199,7 @@ func main() {
 	}
 
 	errChan := make(chan error)
-	for i := uint64(0); i < cfg.Config.ReplicationLog.Shards; i++ {
-		go changeListener(streamDB, replicator, ctxSt, eventBus, i+1, errChan)
-	}
+	go changeListener(streamDB, replicator, ctxSt, eventBus, errChan)
 
 	sleepTimeout := utils.AutoResetEventTimer(
 		eventBus,
@@ -153,6 +227,16 @@ func main() {
 			} else if cnt > 0 {
 				log.Debug().Int64("count", cnt).Msg("Cleaned up DB change logs")
 			}
+
+			if cfg.Config.ReplicationLog.TombstoneRetention > 0 {
+				retention := time.Duration(cfg.Config.ReplicationLog.TombstoneRetention) * time.Millisecond
+				cnt, err = streamDB.CleanupTombstones(t.Add(-retention))
+				if err != nil {
+					log.Warn().Err(err).Msg("Unable to cleanup row tombstones")
+				} else if cnt > 0 {
+					log.Debug().Int64("count", cnt).Msg("Cleaned up row tombstones")
+				}
+			}
 		case <-snapshotTicker.Channel():
 			if cfg.Config.Snapshot.Enable && cfg.Config.Publish {
 				lastSnapshotTime := replicator.LastSaveSnapshotTime()
@@ -183,40 +267,139 @@ func changeListener(
 	rep *logstream.Replicator,
 	ctxSt *utils.StateContext,
 	events EventBus.BusPublisher,
-	shard uint64,
 	errChan chan error,
 ) {
-	log.Debug().Uint64("shard", shard).Msg("Listening stream")
-	err := rep.Listen(shard, onChangeEvent(streamDB, ctxSt, events))
+	err := rep.Listen(onChangeEvent(streamDB, ctxSt, events))
 	if err != nil {
 		errChan <- err
 	}
 }
 
-func onChangeEvent(streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, events EventBus.BusPublisher) func(data []byte) error {
-	return func(data []byte) error {
+// listSnapshots lists stored snapshot versions, newest first
+func listSnapshots(s *snapshot.NatsDBSnapshot) error {
+	manifests, err := s.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range manifests {
+		log.Info().
+			Str("version", m.Version).
+			Time("created_at", m.CreatedAt).
+			Uint64("node", m.NodeID).
+			Str("format", m.Format).
+			Int64("size", m.Size).
+			Int("chunks", len(m.Chunks)).
+			Interface("sequences", m.Sequences).
+			Msg("Snapshot")
+	}
+
+	return nil
+}
+
+// manageDeadLetters lists dead-letter entries of all nodes, or retries or discards entries of this node
+func manageDeadLetters(r *logstream.Replicator, callback logstream.ReplicationListener) error {
+	action := *cfg.DeadLetterFlag
+	switch action {
+	case "list", "retry", "discard":
+	default:
+		return fmt.Errorf("unknown dead-letter action: %s", action)
+	}
+
+	entries, err := r.DeadLetters()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if *cfg.DeadLetterSeqFlag != 0 && entry.Seq != *cfg.DeadLetterSeqFlag {
+			continue
+		}
+
+		if action == "list" {
+			log.Info().
+				Uint64("seq", entry.Seq).
+				Time("time", entry.Time).
+				Str("stream", entry.Stream).
+				Uint64("stream_seq", entry.StreamSeq).
+				Uint64("origin_node", entry.OriginNode).
+				Uint64("failed_node", entry.Node).
+				Str("error", entry.Error).
+				Msg("Dead-letter entry")
+			continue
+		}
+
+		// Entries can only be applied to database of node they failed on
+		if entry.Node != cfg.Config.NodeID {
+			continue
+		}
+
+		if action == "retry" {
+			err = r.RetryDeadLetter(entry, callback)
+		} else {
+			err = r.DiscardDeadLetter(entry)
+		}
+
+		if err != nil {
+			log.Error().Err(err).Uint64("seq", entry.Seq).Msg("Unable to " + action + " dead-letter entry")
+			continue
+		}
+
+		log.Info().Uint64("seq", entry.Seq).Str("action", action).Msg("Processed dead-letter entry")
+	}
+
+	return nil
+}
+
+func onChangeEvent(streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, events EventBus.BusPublisher) logstream.ReplicationListener {
+	return func(streamName string, seq uint64, entries []logstream.ReplicationEntry) error {
 		events.Publish("pulse")
 		if ctxSt.IsCanceled() {
 			return context.Canceled
 		}
 
+		position := &db.StreamPosition{Stream: streamName, Seq: seq}
 		if !cfg.Config.Replicate {
-			return nil
+			return streamDB.ReplicateBatch(nil, position)
 		}
 
-		ev := &logstream.ReplicationEvent[db.ChangeLogEvent]{}
-		err := ev.Unmarshal(data)
-		if err != nil {
-			log.Error().Err(err).Send()
-			return err
+		txs := make([]*db.ChangeLogTransaction, 0, len(entries))
+		for _, entry := range entries {
+			ev := &logstream.ReplicationEvent[db.ChangeLogTransaction]{}
+			err := ev.Unmarshal(entry.Payload)
+			if err != nil {
+				log.Error().Err(err).Send()
+				return err
+			}
+
+			err = ev.Verify()
+			if err == nil {
+				err = signing.Authorize(ev.FromNodeId, ev.Payload.Tables())
+			}
+
+			if err != nil {
+				err = signing.Quarantine(streamName, entry.Seq, entry.Payload, err)
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			tx := ev.Payload.FilterTables(cfg.Config.Tables.CanReplicate)
+			if tx.IsEmpty() {
+				continue
+			}
+
+			txs = append(txs, &tx)
 		}
 
-		return streamDB.Replicate(&ev.Payload)
+		return streamDB.ReplicateBatch(txs, position)
 	}
 }
 
-func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events EventBus.BusPublisher, nodeID uint64) func(event *db.ChangeLogEvent) error {
-	return func(event *db.ChangeLogEvent) error {
+func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events EventBus.BusPublisher, nodeID uint64) func(txs []*db.ChangeLogTransaction) error {
+	return func(txs []*db.ChangeLogTransaction) error {
 		events.Publish("pulse")
 		if ctxSt.IsCanceled() {
 			return context.Canceled
@@ -226,26 +409,74 @@ func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events E
 			return nil
 		}
 
-		ev := &logstream.ReplicationEvent[db.ChangeLogEvent]{
-			FromNodeId: nodeID,
-			Payload:    *event,
-		}
-
-		data, err := ev.Marshal()
+		batch := r.NewPublishBatch()
+		err := publishChanges(batch, txs, nodeID)
+		waitErr := batch.Wait()
 		if err != nil {
 			return err
 		}
 
-		hash, err := event.Hash()
-		if err != nil {
-			return err
+		return waitErr
+	}
+}
+
+func publishChanges(batch *logstream.PublishBatch, txs []*db.ChangeLogTransaction, nodeID uint64) error {
+	for _, tx := range txs {
+		filtered := tx.FilterTables(cfg.Config.Tables.CanPublish)
+		if filtered.IsEmpty() {
+			continue
 		}
 
-		err = r.Publish(hash, data)
+		if filtered.IsSchemaChange() {
+			ev := &logstream.ReplicationEvent[db.ChangeLogTransaction]{
+				FromNodeId: nodeID,
+				Payload:    filtered,
+			}
+
+			data, err := ev.Marshal()
+			if err != nil {
+				return err
+			}
+
+			err = batch.PublishAll(data)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		err := publishTransaction(batch, filtered, nodeID)
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// publishTransaction publishes tx as a single entry on shard of its first change, transactions
+// exceeding maximum payload fail as a whole since parts would be applied on their own
+func publishTransaction(batch *logstream.PublishBatch, tx db.ChangeLogTransaction, nodeID uint64) error {
+	ev := &logstream.ReplicationEvent[db.ChangeLogTransaction]{
+		FromNodeId: nodeID,
+		Payload:    tx,
+	}
 
-		return nil
+	data, err := ev.Marshal()
+	if err != nil {
+		return err
+	}
+
+	hash, err := tx.Hash()
+	if err != nil {
+		return err
 	}
+
+	err = batch.Publish(hash, tx.MessageID(nodeID), tx.Events[0].TableName, data)
+	if errors.Is(err, logstream.ErrPayloadTooLarge) {
+		return fmt.Errorf("commit group %d with %d changes: %w", tx.CommitGroup, len(tx.Events), err)
+	}
+
+	return err
 }
@@ -0,0 +1,163 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/telemetry"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrUnsigned = errors.New("change is not signed")
+var ErrUnknownSigner = errors.New("change signed by unknown node")
+var ErrInvalidSignature = errors.New("invalid change signature")
+var ErrUnauthorizedTable = errors.New("node is not allowed to publish changes of table")
+var ErrInvalidSigningKey = errors.New("invalid signing key")
+
+var privateKey ed25519.PrivateKey
+var trusted map[uint64]ed25519.PublicKey
+var quarantined telemetry.Counter = telemetry.NoopStat{}
+
+// Initialize loads signing key of this node and public keys of trusted nodes, this node
+// trusts its own key unless it's listed with another one
+func Initialize() error {
+	privateKey = nil
+	trusted = make(map[uint64]ed25519.PublicKey, len(cfg.Config.Signing.Trusted))
+	quarantined = telemetry.NewCounter("quarantined", "number of replicated changes rejected to quarantine")
+	for _, node := range cfg.Config.Signing.Trusted {
+		key, err := base64.StdEncoding.DecodeString(node.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("%w: public key of node %d", ErrInvalidSigningKey, node.NodeID)
+		}
+
+		trusted[node.NodeID] = key
+	}
+
+	if !cfg.Config.Signing.Enable {
+		return nil
+	}
+
+	key, err := readPrivateKey(cfg.Config.Signing.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	privateKey = key
+	if _, ok := trusted[cfg.Config.NodeID]; !ok {
+		trusted[cfg.Config.NodeID] = key.Public().(ed25519.PublicKey)
+	}
+
+	return nil
+}
+
+// Enabled tells if published changes are to be signed
+func Enabled() bool {
+	return privateKey != nil
+}
+
+// Sign returns signature of data by this node
+func Sign(data []byte) []byte {
+	return ed25519.Sign(privateKey, data)
+}
+
+// Verify checks data was signed by trusted node nodeID, anything passes unless verify is enabled
+func Verify(nodeID uint64, data []byte, signature []byte) error {
+	if !cfg.Config.Signing.Verify {
+		return nil
+	}
+
+	if len(signature) == 0 {
+		return ErrUnsigned
+	}
+
+	key, ok := trusted[nodeID]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownSigner, nodeID)
+	}
+
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("%w: node %d", ErrInvalidSignature, nodeID)
+	}
+
+	return nil
+}
+
+// Authorize checks node is allowed to publish changes of all tables
+func Authorize(nodeID uint64, tables []string) error {
+	for _, table := range tables {
+		if !cfg.Config.Signing.CanPublish(nodeID, table) {
+			return fmt.Errorf("%w: node %d, table %s", ErrUnauthorizedTable, nodeID, table)
+		}
+	}
+
+	return nil
+}
+
+// Quarantine writes rejected change to quarantine directory, file is named after stream sequence
+// it was received at so redelivered changes don't pile up
+func Quarantine(streamName string, seq uint64, data []byte, cause error) error {
+	dir := cfg.Config.Signing.QuarantinePath
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return err
+	}
+
+	filePath := path.Join(dir, fmt.Sprintf("%s-%d.cbor", streamName, seq))
+	err = os.WriteFile(filePath, data, 0640)
+	if err != nil {
+		return err
+	}
+
+	quarantined.Inc()
+	log.Warn().
+		Err(cause).
+		Str("stream", streamName).
+		Uint64("seq", seq).
+		Str("path", filePath).
+		Msg("Rejected replicated change to quarantine")
+	return nil
+}
+
+// GenerateKey writes new private key to filePath, returning its base64 encoded public key
+func GenerateKey(filePath string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.WriteFile(filePath, []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// readPrivateKey reads base64 encoded ed25519 seed or private key
+func readPrivateKey(filePath string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSigningKey, filePath)
+	}
+
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return raw, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrInvalidSigningKey, filePath)
+}
@@ -0,0 +1,309 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/encryption"
+	"github.com/rs/zerolog/log"
+)
+
+const chunkPrefix = "chunk-"
+const chunkFileName = "chunk.db"
+
+// Unreferenced chunks younger than this might belong to a snapshot still being uploaded
+const chunkGracePeriod = 1 * time.Hour
+
+// newChunkDigest returns hash chunks are named and verified with, it's keyed by snapshot key keyID
+// when snapshots are encrypted so names don't give away content of chunks
+func newChunkDigest(keyID string) (hash.Hash, error) {
+	if keyID == "" {
+		return sha256.New(), nil
+	}
+
+	return encryption.NewDigest(keyID)
+}
+
+// chunkObjectName addresses chunk by digest of its content and format it's encoded in, so an
+// unchanged range of pages maps to an already uploaded object
+func chunkObjectName(digest hash.Hash, format string, data []byte) string {
+	digest.Reset()
+	digest.Write([]byte(format))
+	digest.Write([]byte{0})
+	digest.Write(data)
+	return chunkPrefix + hex.EncodeToString(digest.Sum(nil))
+}
+
+// splitChunks splits content of r into ChunkSize chunks encoded in Format and named by digest
+// keyed by ChunkKeyID of manifest, calling upload with every chunk in order. It records chunk
+// names along with Size and Checksum of content in manifest. Data passed to upload is reused.
+func splitChunks(r io.Reader, manifest *Manifest, upload func(name string, data []byte) error) error {
+	if manifest.ChunkSize <= 0 {
+		return fmt.Errorf("invalid snapshot chunk size %d", manifest.ChunkSize)
+	}
+
+	h, err := newChunkDigest(manifest.ChunkKeyID)
+	if err != nil {
+		return err
+	}
+
+	digest, err := newChunkDigest(manifest.ChunkKeyID)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, manifest.ChunkSize)
+	size := int64(0)
+	chunks := make([]string, 0)
+	for {
+		read, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		data := buf[:read]
+		h.Write(data)
+		size += int64(read)
+		name := chunkObjectName(digest, manifest.Format, data)
+		chunks = append(chunks, name)
+		err = upload(name, data)
+		if err != nil {
+			return err
+		}
+
+		if read < len(buf) {
+			break
+		}
+	}
+
+	manifest.Size = size
+	manifest.Checksum = hex.EncodeToString(h.Sum(nil))
+	manifest.Chunks = chunks
+	return nil
+}
+
+// joinChunks writes chunks of manifest returned by fetch to w in order, verifying every chunk
+// against its name and reassembled content against Size and Checksum of manifest
+func joinChunks(w io.Writer, manifest *Manifest, fetch func(name string) ([]byte, error)) error {
+	h, err := newChunkDigest(manifest.ChunkKeyID)
+	if err != nil {
+		return err
+	}
+
+	digest, err := newChunkDigest(manifest.ChunkKeyID)
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	w = io.MultiWriter(w, h)
+	for _, name := range manifest.Chunks {
+		data, err := fetch(name)
+		if err != nil {
+			return err
+		}
+
+		if int64(len(data)) > manifest.ChunkSize || chunkObjectName(digest, manifest.Format, data) != name {
+			return fmt.Errorf("%w: %s checksum mismatch", ErrInvalidSnapshot, name)
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+
+		size += int64(len(data))
+	}
+
+	if size != manifest.Size || hex.EncodeToString(h.Sum(nil)) != manifest.Checksum {
+		return fmt.Errorf("%w: %s reassembled database checksum mismatch", ErrInvalidSnapshot, manifest.Version)
+	}
+
+	return nil
+}
+
+// uploadChunks splits database file at bkFilePath into chunks and uploads the ones previous
+// snapshot doesn't have
+func (n *NatsDBSnapshot) uploadChunks(dir string, bkFilePath string, manifest *Manifest) error {
+	f, err := os.Open(bkFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if encryption.Enabled() {
+		manifest.ChunkKeyID, err = encryption.ActiveKeyID()
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest.Format = artifactFormat()
+	manifest.ChunkSize = cfg.Config.Snapshot.ChunkSize
+	known := n.previousChunks(dir)
+	chunkPath := path.Join(dir, chunkFileName)
+	uploaded := 0
+	err = splitChunks(f, manifest, func(name string, data []byte) error {
+		if known[name] {
+			return nil
+		}
+
+		err := n.uploadChunk(dir, chunkPath, name, data)
+		if err != nil {
+			return err
+		}
+
+		known[name] = true
+		uploaded++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("chunks", len(manifest.Chunks)).
+		Int("uploaded", uploaded).
+		Msg("Uploaded incremental snapshot chunks")
+	return nil
+}
+
+func (n *NatsDBSnapshot) uploadChunk(dir string, chunkPath string, name string, data []byte) error {
+	err := os.WriteFile(chunkPath, data, 0640)
+	if err != nil {
+		return err
+	}
+
+	encPath, _, err := encodeArtifact(dir, chunkPath)
+	if err != nil {
+		return err
+	}
+
+	return n.storage.Upload(name, encPath)
+}
+
+// previousChunks returns chunks of latest snapshot, everything is uploaded again when it
+// can't be read
+func (n *NatsDBSnapshot) previousChunks(dir string) map[string]bool {
+	ret := make(map[string]bool)
+	objects, err := n.storage.List()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to list snapshots, uploading all chunks")
+		return ret
+	}
+
+	versions := listVersions(objects)
+	if len(versions) == 0 || versions[0].name == LegacyVersion {
+		return ret
+	}
+
+	manifest, err := n.fetchManifest(versions[0].name, dir)
+	if err != nil {
+		log.Warn().Err(err).Str("version", versions[0].name).Msg("Unable to fetch previous snapshot, uploading all chunks")
+		return ret
+	}
+
+	for _, name := range manifest.Chunks {
+		ret[name] = true
+	}
+
+	return ret
+}
+
+// fetchChunks downloads and decodes chunks of manifest reassembling them into bkFilePath
+func (n *NatsDBSnapshot) fetchChunks(dir string, bkFilePath string, manifest *Manifest) error {
+	out, err := os.Create(bkFilePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	chunkPath := path.Join(dir, chunkFileName)
+	err = joinChunks(out, manifest, func(name string) ([]byte, error) {
+		return n.fetchChunk(dir, chunkPath, name, manifest.Format)
+	})
+	if err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+func (n *NatsDBSnapshot) fetchChunk(dir string, chunkPath string, name string, format string) ([]byte, error) {
+	defer os.Remove(chunkPath)
+	err := n.storage.Download(chunkPath, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = decodeArtifact(dir, chunkPath, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(chunkPath)
+}
+
+// removeUnusedChunks deletes chunks no kept version references, it removes nothing unless
+// manifests of all kept versions can be read
+func (n *NatsDBSnapshot) removeUnusedChunks(dir string, objects []*ObjectInfo, kept []*snapshotVersion) error {
+	chunks := make([]*ObjectInfo, 0)
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Name, chunkPrefix) {
+			chunks = append(chunks, obj)
+		}
+	}
+
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	referenced := make(map[string]bool)
+	for _, v := range kept {
+		if v.name == LegacyVersion {
+			continue
+		}
+
+		manifest, err := n.fetchManifest(v.name, dir)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range manifest.Chunks {
+			referenced[name] = true
+		}
+	}
+
+	removed := 0
+	for _, obj := range chunks {
+		if referenced[obj.Name] || time.Since(obj.ModTime) < chunkGracePeriod {
+			continue
+		}
+
+		err := n.storage.Delete(obj.Name)
+		if err != nil {
+			return err
+		}
+
+		removed++
+	}
+
+	if removed > 0 {
+		log.Info().Int("chunks", removed).Msg("Removed unused snapshot chunks")
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/maxpert/marmot/encryption"
+)
+
+const testChunkSize = 16
+
+func testContent(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i / testChunkSize)
+	}
+
+	return data
+}
+
+// splitTestContent splits data returning manifest and stored copies of uploaded chunks
+func splitTestContent(t *testing.T, data []byte, keyID string) (*Manifest, map[string][]byte) {
+	manifest := &Manifest{Format: "zstd", ChunkSize: testChunkSize, ChunkKeyID: keyID}
+	stored := make(map[string][]byte)
+	err := splitChunks(bytes.NewReader(data), manifest, func(name string, data []byte) error {
+		stored[name] = append([]byte{}, data...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("splitChunks() error = %v", err)
+	}
+
+	return manifest, stored
+}
+
+func fetchStored(stored map[string][]byte) func(name string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		data, ok := stored[name]
+		if !ok {
+			return nil, ErrNoSnapshotFound
+		}
+
+		return data, nil
+	}
+}
+
+func TestSplitJoinChunks(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		encrypted  bool
+		wantChunks int
+	}{
+		{"empty", 0, false, 0},
+		{"shorter than chunk", 5, false, 1},
+		{"exactly one chunk", testChunkSize, false, 1},
+		{"multiple of chunk size", 3 * testChunkSize, false, 3},
+		{"with remainder", 3*testChunkSize + 7, false, 4},
+		{"keyed digest", 3*testChunkSize + 7, true, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyID := ""
+			if tt.encrypted {
+				encryption.EnableTestKeyring(t, "k1", "k1", "k2")
+				keyID = "k1"
+			}
+
+			data := testContent(tt.size)
+			manifest, stored := splitTestContent(t, data, keyID)
+			if len(manifest.Chunks) != tt.wantChunks {
+				t.Errorf("splitChunks() made %d chunks, want %d", len(manifest.Chunks), tt.wantChunks)
+			}
+
+			if manifest.Size != int64(tt.size) {
+				t.Errorf("manifest size = %d, want %d", manifest.Size, tt.size)
+			}
+
+			for _, name := range manifest.Chunks {
+				if !strings.HasPrefix(name, chunkPrefix) {
+					t.Errorf("chunk name %s has no prefix %s", name, chunkPrefix)
+				}
+			}
+
+			out := &bytes.Buffer{}
+			err := joinChunks(out, manifest, fetchStored(stored))
+			if err != nil {
+				t.Fatalf("joinChunks() error = %v", err)
+			}
+
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("joinChunks() content differs from split content")
+			}
+		})
+	}
+}
+
+func TestSplitChunksNamesByContent(t *testing.T) {
+	// Chunks 0 and 2 have same content
+	data := append(append(bytes.Repeat([]byte{1}, testChunkSize), bytes.Repeat([]byte{2}, testChunkSize)...),
+		bytes.Repeat([]byte{1}, testChunkSize)...)
+	manifest, stored := splitTestContent(t, data, "")
+	if len(manifest.Chunks) != 3 || manifest.Chunks[0] != manifest.Chunks[2] || manifest.Chunks[0] == manifest.Chunks[1] {
+		t.Errorf("splitChunks() names = %v, want equal names for equal content only", manifest.Chunks)
+	}
+
+	if len(stored) != 2 {
+		t.Errorf("splitChunks() stored %d distinct chunks, want 2", len(stored))
+	}
+
+	other := &Manifest{Format: "none", ChunkSize: testChunkSize}
+	err := splitChunks(bytes.NewReader(data), other, func(string, []byte) error { return nil })
+	if err != nil {
+		t.Fatalf("splitChunks() error = %v", err)
+	}
+
+	if other.Chunks[0] == manifest.Chunks[0] {
+		t.Error("chunks encoded in different formats have same name")
+	}
+}
+
+func TestSplitChunksKeyedNames(t *testing.T) {
+	encryption.EnableTestKeyring(t, "k1", "k1", "k2")
+	data := testContent(2 * testChunkSize)
+	plain, _ := splitTestContent(t, data, "")
+	k1, _ := splitTestContent(t, data, "k1")
+	k1Again, _ := splitTestContent(t, data, "k1")
+	k2, _ := splitTestContent(t, data, "k2")
+
+	if k1.Chunks[0] == plain.Chunks[0] || k1.Checksum == plain.Checksum {
+		t.Error("keyed chunk names or checksum equal plain SHA-256")
+	}
+
+	if k1.Chunks[0] != k1Again.Chunks[0] {
+		t.Error("same content under same key has different names")
+	}
+
+	if k1.Chunks[0] == k2.Chunks[0] {
+		t.Error("same content under different keys has same name")
+	}
+}
+
+func TestSplitChunksInvalidSize(t *testing.T) {
+	err := splitChunks(bytes.NewReader([]byte{1}), &Manifest{}, func(string, []byte) error { return nil })
+	if err == nil {
+		t.Error("splitChunks() with zero chunk size didn't fail")
+	}
+}
+
+func TestJoinChunksCorrupt(t *testing.T) {
+	data := testContent(3*testChunkSize + 7)
+	tests := []struct {
+		name    string
+		corrupt func(manifest *Manifest, stored map[string][]byte)
+		wantErr error
+	}{
+		{
+			name: "tampered chunk",
+			corrupt: func(manifest *Manifest, stored map[string][]byte) {
+				stored[manifest.Chunks[1]][0] ^= 1
+			},
+			wantErr: ErrInvalidSnapshot,
+		},
+		{
+			name: "oversized chunk",
+			corrupt: func(manifest *Manifest, stored map[string][]byte) {
+				manifest.ChunkSize = 4
+			},
+			wantErr: ErrInvalidSnapshot,
+		},
+		{
+			name: "reordered chunks",
+			corrupt: func(manifest *Manifest, stored map[string][]byte) {
+				manifest.Chunks[0], manifest.Chunks[1] = manifest.Chunks[1], manifest.Chunks[0]
+			},
+			wantErr: ErrInvalidSnapshot,
+		},
+		{
+			name: "dropped chunk",
+			corrupt: func(manifest *Manifest, stored map[string][]byte) {
+				manifest.Chunks = manifest.Chunks[:len(manifest.Chunks)-1]
+			},
+			wantErr: ErrInvalidSnapshot,
+		},
+		{
+			name: "missing chunk",
+			corrupt: func(manifest *Manifest, stored map[string][]byte) {
+				delete(stored, manifest.Chunks[2])
+			},
+			wantErr: ErrNoSnapshotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, stored := splitTestContent(t, data, "")
+			tt.corrupt(manifest, stored)
+			err := joinChunks(&bytes.Buffer{}, manifest, fetchStored(stored))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("joinChunks() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
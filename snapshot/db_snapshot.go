@@ -1,20 +1,24 @@
 package snapshot
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"os"
 	"path"
 	"sync"
 	"time"
 
+	"github.com/maxpert/marmot/cfg"
 	"github.com/maxpert/marmot/db"
 	"github.com/rs/zerolog/log"
 )
 
 var ErrPendingSnapshot = errors.New("system busy capturing snapshot")
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+var ErrNoValidSnapshot = errors.New("no valid snapshot found")
 
 const snapshotFileName = "snapshot.db"
 const tempDirPattern = "marmot-snapshot-*"
@@ -46,16 +50,86 @@ func (n *NatsDBSnapshot) SaveSnapshot() error {
 	}
 	defer cleanupDir(tmpSnapshot)
 
+	// Chunks need a page for page copy, VACUUM rewrites whole file shifting every page after a change
 	bkFilePath := path.Join(tmpSnapshot, snapshotFileName)
-	err = n.db.BackupTo(bkFilePath)
+	backup := n.db.BackupTo
+	if cfg.Config.Snapshot.Incremental {
+		backup = n.db.BackupPagesTo
+	}
+
+	seq, err := backup(bkFilePath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	manifest := &Manifest{
+		Version:   newSnapshotVersion(now, seq, cfg.Config.NodeID),
+		NodeID:    cfg.Config.NodeID,
+		CreatedAt: now,
+		Sequences: seq,
+	}
+
+	if cfg.Config.Snapshot.Incremental {
+		err = n.uploadChunks(tmpSnapshot, bkFilePath, manifest)
+	} else {
+		err = n.uploadFile(tmpSnapshot, bkFilePath, manifest)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	manifestPath := path.Join(tmpSnapshot, manifestFileName)
+	err = manifest.writeTo(manifestPath)
 	if err != nil {
 		return err
 	}
 
-	return n.storage.Upload(snapshotFileName, bkFilePath)
+	// Manifest goes last, versions without one are incomplete and never restored
+	err = n.storage.Upload(manifestObjectName(manifest.Version), manifestPath)
+	if err != nil {
+		return err
+	}
+
+	err = n.applyRetention(tmpSnapshot)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to remove expired snapshots")
+	}
+
+	return nil
 }
 
-func (n *NatsDBSnapshot) RestoreSnapshot() error {
+// uploadFile uploads whole database file at bkFilePath as data object of manifest version
+func (n *NatsDBSnapshot) uploadFile(dir string, bkFilePath string, manifest *Manifest) error {
+	bkFilePath, format, err := encodeArtifact(dir, bkFilePath)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(bkFilePath)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(bkFilePath)
+	if err != nil {
+		return err
+	}
+
+	manifest.Format = format
+	manifest.Size = info.Size()
+	manifest.Checksum = checksum
+	return n.storage.Upload(dataObjectName(manifest.Version), bkFilePath)
+}
+
+// RestoreSnapshot restores given version, or latest valid version if version is empty or
+// LatestVersion falling back to older versions
+func (n *NatsDBSnapshot) RestoreSnapshot(version string) error {
+	if version == LatestVersion {
+		version = ""
+	}
+
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
@@ -65,27 +139,215 @@ func (n *NatsDBSnapshot) RestoreSnapshot() error {
 	}
 	defer cleanupDir(tmpSnapshotPath)
 
-	bkFilePath := path.Join(tmpSnapshotPath, snapshotFileName)
-	err = n.storage.Download(bkFilePath, snapshotFileName)
-	if err == ErrNoSnapshotFound {
-		log.Warn().Err(err).Msg("System will now continue without restoring snapshot")
+	candidates := []string{version}
+	if version == "" {
+		objects, err := n.storage.List()
+		if err != nil {
+			return err
+		}
+
+		candidates = make([]string, 0)
+		for _, v := range listVersions(objects) {
+			candidates = append(candidates, v.name)
+		}
+	}
+
+	if len(candidates) == 0 {
+		log.Warn().Err(ErrNoSnapshotFound).Msg("System will now continue without restoring snapshot")
 		return nil
 	}
 
+	for _, v := range candidates {
+		bkFilePath, manifest, err := n.fetchVersion(v, tmpSnapshotPath)
+		if err != nil && version == "" {
+			log.Warn().Err(err).Str("version", v).Msg("Unable to fetch snapshot, trying previous version")
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return n.restore(bkFilePath, manifest)
+	}
+
+	return ErrNoValidSnapshot
+}
+
+// ListSnapshots returns manifests of stored snapshots newest first, versions with manifest that
+// can't be read are reported and left out
+func (n *NatsDBSnapshot) ListSnapshots() ([]*Manifest, error) {
+	tmpSnapshotPath, err := os.MkdirTemp(os.TempDir(), tempDirPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupDir(tmpSnapshotPath)
+
+	objects, err := n.storage.List()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Manifest, 0)
+	for _, v := range listVersions(objects) {
+		manifest, err := n.fetchManifest(v.name, tmpSnapshotPath)
+		if errors.Is(err, ErrNoSnapshotFound) && v.name == LegacyVersion {
+			manifest, err = &Manifest{Version: LegacyVersion, CreatedAt: v.time}, nil
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Str("version", v.name).Msg("Unable to read snapshot manifest, skipping")
+			continue
+		}
+
+		ret = append(ret, manifest)
+	}
+
+	return ret, nil
+}
+
+// fetchVersion downloads and decodes snapshot version into dir verifying its checksum and
+// integrity, manifest is nil for legacy snapshots uploaded without one
+func (n *NatsDBSnapshot) fetchVersion(version string, dir string) (string, *Manifest, error) {
+	manifest, err := n.fetchManifest(version, dir)
+	if errors.Is(err, ErrNoSnapshotFound) && version == LegacyVersion {
+		log.Warn().Msg("Snapshot has no manifest, replication log will be applied from its first entry")
+		manifest, err = nil, nil
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	bkFilePath := path.Join(dir, snapshotFileName)
+	if manifest != nil && len(manifest.Chunks) > 0 {
+		err = n.fetchChunks(dir, bkFilePath, manifest)
+	} else {
+		err = n.fetchFile(dir, bkFilePath, version, manifest)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Live database is only touched once downloaded one is known to be intact
+	err = db.CheckIntegrity(bkFilePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+
+	return bkFilePath, manifest, nil
+}
+
+// fetchFile downloads snapshot uploaded as a single file and decodes it into bkFilePath
+func (n *NatsDBSnapshot) fetchFile(dir string, bkFilePath string, version string, manifest *Manifest) error {
+	name := dataObjectName(version)
+	if manifest != nil && manifest.Size != 0 {
+		info, err := n.storage.Stat(name)
+		if err != nil {
+			return err
+		}
+
+		if info.Size != manifest.Size {
+			return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrInvalidSnapshot, name, info.Size, manifest.Size)
+		}
+	}
+
+	err := n.storage.Download(bkFilePath, name)
 	if err != nil {
 		return err
 	}
 
+	if manifest != nil && manifest.Checksum != "" {
+		checksum, err := fileChecksum(bkFilePath)
+		if err != nil {
+			return err
+		}
+
+		if checksum != manifest.Checksum {
+			return fmt.Errorf("%w: %s checksum mismatch", ErrInvalidSnapshot, name)
+		}
+	}
+
+	format := ""
+	if manifest != nil {
+		format = manifest.Format
+	}
+
+	return decodeArtifact(dir, bkFilePath, format)
+}
+
+func (n *NatsDBSnapshot) fetchManifest(version string, dir string) (*Manifest, error) {
+	manifestPath := path.Join(dir, manifestFileName)
+	err := n.storage.Download(manifestPath, manifestObjectName(version))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Version == "" {
+		manifest.Version = version
+	}
+
+	return manifest, nil
+}
+
+func (n *NatsDBSnapshot) restore(bkFilePath string, manifest *Manifest) error {
 	log.Info().Str("path", bkFilePath).Msg("Downloaded snapshot, restoring...")
-	err = db.RestoreFrom(n.db.GetPath(), bkFilePath)
+	err := db.RestoreFrom(n.db.GetPath(), bkFilePath)
 	if err != nil {
 		return err
 	}
 
+	if manifest != nil {
+		err = n.db.RestoreSequences(manifest.Sequences)
+		if err != nil {
+			return err
+		}
+
+		log.Info().
+			Str("version", manifest.Version).
+			Uint64("node", manifest.NodeID).
+			Time("created_at", manifest.CreatedAt).
+			Interface("sequences", manifest.Sequences).
+			Msg("Restored replication state from snapshot manifest")
+	}
+
 	log.Info().Str("path", bkFilePath).Msg("Restore complete...")
 	return nil
 }
 
+// applyRetention removes expired versions and chunks no longer referenced by any kept version
+func (n *NatsDBSnapshot) applyRetention(dir string) error {
+	objects, err := n.storage.List()
+	if err != nil {
+		return err
+	}
+
+	keepAge := time.Duration(cfg.Config.Snapshot.KeepDays) * 24 * time.Hour
+	expired, kept := selectExpiredVersions(objects, cfg.Config.Snapshot.KeepCount, keepAge, time.Now())
+	for _, version := range expired {
+		// Manifest goes first so a partially removed version is never restored
+		err = n.storage.Delete(manifestObjectName(version))
+		if err != nil {
+			return err
+		}
+
+		err = n.storage.Delete(dataObjectName(version))
+		if err != nil {
+			return err
+		}
+
+		log.Info().Str("version", version).Msg("Removed expired snapshot")
+	}
+
+	return n.removeUnusedChunks(dir, objects, kept)
+}
+
 func cleanupDir(p string) {
 	for i := 0; i < 5; i++ {
 		err := os.RemoveAll(p)
@@ -100,17 +362,17 @@ func cleanupDir(p string) {
 	log.Error().Str("path", p).Msg("Unable to cleanup temp path, this might cause disk wastage")
 }
 
-func fileHash(p string) (string, error) {
+func fileChecksum(p string) (string, error) {
 	f, err := os.Open(p)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	h := fnv.New64()
+	h := sha256.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%x", h.Sum64()), nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
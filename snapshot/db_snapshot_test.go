@@ -0,0 +1,204 @@
+package snapshot
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/db"
+)
+
+// dirStorage stores snapshot objects as files of a directory
+type dirStorage struct {
+	dir string
+}
+
+func copyTestFile(dst string, src string) error {
+	in, err := os.Open(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (s *dirStorage) Upload(name, filePath string) error {
+	return copyTestFile(path.Join(s.dir, name), filePath)
+}
+
+func (s *dirStorage) Download(filePath, name string) error {
+	return copyTestFile(filePath, path.Join(s.dir, name))
+}
+
+func (s *dirStorage) List() ([]*ObjectInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*ObjectInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := s.Stat(e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
+
+func (s *dirStorage) Stat(name string) (*ObjectInfo, error) {
+	info, err := os.Stat(path.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *dirStorage) Delete(name string) error {
+	err := os.Remove(path.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// openTestSnapshot opens database holding single value snapshotted into directory storage
+func openTestSnapshot(t *testing.T) (*NatsDBSnapshot, *dirStorage, *sql.DB) {
+	snapshotCfg := cfg.Config.Snapshot
+	t.Cleanup(func() { cfg.Config.Snapshot = snapshotCfg })
+	cfg.Config.Snapshot.Incremental = false
+	cfg.Config.Snapshot.KeepCount = 10
+
+	dbPath := path.Join(t.TempDir(), "test.db")
+	raw, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+
+	_, err = raw.Exec("CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT); INSERT INTO kv VALUES ('k', 'v1');")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamDB, err := db.OpenStreamDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenStreamDB() error = %v", err)
+	}
+
+	storage := &dirStorage{dir: t.TempDir()}
+	return NewNatsDBSnapshot(streamDB, storage), storage, raw
+}
+
+// saveTestVersion sets value and saves snapshot of it, returning saved version
+func saveTestVersion(t *testing.T, s *NatsDBSnapshot, raw *sql.DB, value string) string {
+	_, err := raw.Exec("UPDATE kv SET v = ?", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Versions are named by milliseconds
+	time.Sleep(2 * time.Millisecond)
+	err = s.SaveSnapshot()
+	if err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+
+	manifests, err := s.ListSnapshots()
+	if err != nil || len(manifests) == 0 {
+		t.Fatalf("ListSnapshots() = %v, %v", manifests, err)
+	}
+
+	return manifests[0].Version
+}
+
+func corruptObject(t *testing.T, storage *dirStorage, name string) {
+	p := path.Join(storage.dir, name)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[len(data)/2] ^= 0xff
+	err = os.WriteFile(p, data, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func restoredValue(t *testing.T, s *NatsDBSnapshot) string {
+	raw, err := sql.Open("sqlite3", s.db.GetPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	value := ""
+	err = raw.QueryRow("SELECT v FROM kv").Scan(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestRestoreSnapshotFallsBackOnChecksumMismatch(t *testing.T) {
+	s, storage, raw := openTestSnapshot(t)
+	older := saveTestVersion(t, s, raw, "older")
+	latest := saveTestVersion(t, s, raw, "latest")
+	corruptObject(t, storage, dataObjectName(latest))
+	_, err := raw.Exec("UPDATE kv SET v = 'live'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Explicitly requested version doesn't fall back
+	err = s.RestoreSnapshot(latest)
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("RestoreSnapshot(%s) error = %v, want %v", latest, err, ErrInvalidSnapshot)
+	}
+
+	if got := restoredValue(t, s); got != "live" {
+		t.Errorf("value after failed restore = %s, want live", got)
+	}
+
+	err = s.RestoreSnapshot("")
+	if err != nil {
+		t.Fatalf("RestoreSnapshot() error = %v", err)
+	}
+
+	if got := restoredValue(t, s); got != "older" {
+		t.Errorf("restored value = %s, want older", got)
+	}
+
+	corruptObject(t, storage, dataObjectName(older))
+	if err = s.RestoreSnapshot(LatestVersion); !errors.Is(err, ErrNoValidSnapshot) {
+		t.Errorf("RestoreSnapshot() with every version corrupt error = %v, want %v", err, ErrNoValidSnapshot)
+	}
+}
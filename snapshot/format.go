@@ -0,0 +1,203 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/encryption"
+)
+
+// Format of uploaded snapshot lists layers applied onto SQLite file in order, e.g. sqlite+zstd+aes-256-gcm
+const (
+	formatSQLite = "sqlite"
+	formatZstd   = "zstd"
+	formatAESGCM = "aes-256-gcm"
+)
+
+const artifactFileName = "snapshot.artifact"
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// artifactFormat returns format of snapshots encoded as configured
+func artifactFormat() string {
+	layers := []string{formatSQLite}
+	if cfg.Config.Snapshot.Compress {
+		layers = append(layers, formatZstd)
+	}
+
+	if encryption.Enabled() {
+		layers = append(layers, formatAESGCM)
+	}
+
+	return strings.Join(layers, "+")
+}
+
+// encodeArtifact compresses and encrypts database file at bkFilePath as configured in a single
+// pass, returning path of file to upload and its format. Database file is removed once encoded,
+// so at most database and its encoded copy are on disk at once.
+func encodeArtifact(dir string, bkFilePath string) (string, string, error) {
+	format := artifactFormat()
+	if format == formatSQLite {
+		return bkFilePath, format, nil
+	}
+
+	artifactPath := path.Join(dir, artifactFileName)
+	err := encodeFile(bkFilePath, artifactPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	return artifactPath, format, os.Remove(bkFilePath)
+}
+
+func encodeFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var r io.Reader = in
+	if cfg.Config.Snapshot.Compress {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+
+		go func() {
+			pw.CloseWithError(compress(pw, in))
+		}()
+		r = pr
+	}
+
+	if encryption.Enabled() {
+		err = encryption.EncryptStream(out, r)
+	} else {
+		_, err = io.Copy(out, r)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+func compress(w io.Writer, r io.Reader) error {
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(enc, r)
+	if err != nil {
+		enc.Close()
+		return err
+	}
+
+	return enc.Close()
+}
+
+// decodeArtifact turns downloaded file at bkFilePath back into database file at same path in a
+// single pass, format is detected from file contents when snapshot has none recorded
+func decodeArtifact(dir string, bkFilePath string, format string) error {
+	layers, err := artifactLayers(bkFilePath, format)
+	if err != nil || len(layers) == 1 {
+		return err
+	}
+
+	srcFilePath := path.Join(dir, artifactFileName)
+	err = os.Rename(bkFilePath, srcFilePath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(srcFilePath)
+
+	in, err := os.Open(srcFilePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	for i := len(layers) - 1; i > 0; i-- {
+		switch layers[i] {
+		case formatAESGCM:
+			pr, pw := io.Pipe()
+			defer pr.Close()
+
+			go func(src io.Reader) {
+				pw.CloseWithError(encryption.DecryptStream(pw, src))
+			}(r)
+			r = pr
+		case formatZstd:
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return err
+			}
+			defer dec.Close()
+
+			r = dec
+		default:
+			return fmt.Errorf("%w: unknown format %s", ErrInvalidSnapshot, format)
+		}
+	}
+
+	out, err := os.Create(bkFilePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, r)
+	if err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+func artifactLayers(bkFilePath string, format string) ([]string, error) {
+	if format != "" {
+		layers := strings.Split(format, "+")
+		if layers[0] != formatSQLite {
+			return nil, fmt.Errorf("%w: unknown format %s", ErrInvalidSnapshot, format)
+		}
+
+		return layers, nil
+	}
+
+	// Older snapshots are either plain or encrypted database files
+	encrypted, err := encryption.IsEncryptedFile(bkFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypted {
+		return []string{formatSQLite, formatAESGCM}, nil
+	}
+
+	f, err := os.Open(bkFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == nil && bytes.Equal(magic, zstdMagic) {
+		return []string{formatSQLite, formatZstd}, nil
+	}
+
+	return []string{formatSQLite}, nil
+}
@@ -0,0 +1,52 @@
+package snapshot
+
+import (
+	"os"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const manifestFileName = "snapshot.manifest"
+
+// Manifest describes snapshot it's uploaded along with, Format, Size and Checksum (hex SHA-256)
+// are of uploaded snapshot and Sequences are last applied sequences of replication log streams
+// captured along with snapshot. Incremental snapshots list their ChunkSize chunks in order, each
+// chunk is encoded in Format while Size and Checksum are of reassembled database. Chunk names and
+// Checksum of encrypted incremental snapshots are HMAC-SHA256 keyed by snapshot key ChunkKeyID.
+type Manifest struct {
+	Version    string
+	NodeID     uint64
+	CreatedAt  time.Time
+	Format     string
+	Size       int64
+	Checksum   string
+	Sequences  map[string]uint64
+	ChunkSize  int64    `cbor:",omitempty"`
+	ChunkKeyID string   `cbor:",omitempty"`
+	Chunks     []string `cbor:",omitempty"`
+}
+
+func (m *Manifest) writeTo(filePath string) error {
+	data, err := cbor.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filePath, data, 0640)
+}
+
+func readManifest(filePath string) (*Manifest, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = cbor.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"errors"
+	"time"
 
 	"github.com/maxpert/marmot/cfg"
 )
@@ -10,14 +11,27 @@ var ErrInvalidStorageType = errors.New("invalid snapshot storage type")
 var ErrNoSnapshotFound = errors.New("no snapshot found")
 var ErrRequiredParameterMissing = errors.New("required parameter missing")
 
+// NatsSnapshot saves and restores versioned snapshots, empty version restores latest valid one
 type NatsSnapshot interface {
 	SaveSnapshot() error
-	RestoreSnapshot() error
+	RestoreSnapshot(version string) error
 }
 
+// ObjectInfo describes object stored in snapshot storage
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage stores snapshot objects by name, Stat and Download return ErrNoSnapshotFound
+// for missing objects while Delete ignores them
 type Storage interface {
 	Upload(name, filePath string) error
 	Download(filePath, name string) error
+	List() ([]*ObjectInfo, error)
+	Stat(name string) (*ObjectInfo, error)
+	Delete(name string) error
 }
 
 func NewSnapshotStorage() (Storage, error) {
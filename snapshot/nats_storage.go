@@ -1,6 +1,7 @@
 package snapshot
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -10,7 +11,7 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const hashHeaderKey = "marmot-snapshot-tag"
+const hashHeaderKey = "marmot-snapshot-sha256"
 
 type natsStorage struct {
 	nc *nats.Conn
@@ -27,7 +28,7 @@ func (n *natsStorage) Upload(name, filePath string) error {
 		return err
 	}
 
-	hash, err := fileHash(filePath)
+	hash, err := fileChecksum(filePath)
 	if err != nil {
 		return err
 	}
@@ -65,10 +66,16 @@ func (n *natsStorage) Download(filePath, name string) error {
 		return err
 	}
 
+	// GetFile doesn't truncate existing file
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	for {
 		err = blb.GetFile(name, filePath)
 		if err == nil {
-			return nil
+			return verifyObjectHash(blb, name, filePath)
 		}
 
 		if err == nats.ErrObjectNotFound {
@@ -91,6 +98,85 @@ func (n *natsStorage) Download(filePath, name string) error {
 	}
 }
 
+func (n *natsStorage) List() ([]*ObjectInfo, error) {
+	blb, err := getBlobStore(n.nc)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := blb.List()
+	if err == nats.ErrNoObjectsFound {
+		return []*ObjectInfo{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*ObjectInfo, 0, len(objects))
+	for _, info := range objects {
+		ret = append(ret, &ObjectInfo{Name: info.Name, Size: int64(info.Size), ModTime: info.ModTime})
+	}
+
+	return ret, nil
+}
+
+func (n *natsStorage) Stat(name string) (*ObjectInfo, error) {
+	blb, err := getBlobStore(n.nc)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := blb.GetInfo(name)
+	if err == nats.ErrObjectNotFound {
+		return nil, ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Name: info.Name, Size: int64(info.Size), ModTime: info.ModTime}, nil
+}
+
+func (n *natsStorage) Delete(name string) error {
+	blb, err := getBlobStore(n.nc)
+	if err != nil {
+		return err
+	}
+
+	err = blb.Delete(name)
+	if err == nats.ErrObjectNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// verifyObjectHash checks downloaded file against checksum stored in object headers if any
+func verifyObjectHash(blb nats.ObjectStore, name, filePath string) error {
+	info, err := blb.GetInfo(name)
+	if err != nil {
+		return err
+	}
+
+	expected := info.Headers.Get(hashHeaderKey)
+	if expected == "" {
+		return nil
+	}
+
+	hash, err := fileChecksum(filePath)
+	if err != nil {
+		return err
+	}
+
+	if hash != expected {
+		return fmt.Errorf("%w: %s checksum mismatch", ErrInvalidSnapshot, name)
+	}
+
+	return nil
+}
+
 func getBlobStore(conn *nats.Conn) (nats.ObjectStore, error) {
 	js, err := conn.JetStream(nats.MaxWait(30 * time.Second))
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/maxpert/marmot/cfg"
@@ -49,6 +50,51 @@ func (s s3Storage) Download(filePath, name string) error {
 	return err
 }
 
+func (s s3Storage) List() ([]*ObjectInfo, error) {
+	ctx := context.Background()
+	cS3 := cfg.Config.Snapshot.S3
+	prefix := fmt.Sprintf("%s/", cS3.DirPath)
+	ret := make([]*ObjectInfo, 0)
+	for obj := range s.mc.ListObjects(ctx, cS3.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		ret = append(ret, &ObjectInfo{
+			Name:    strings.TrimPrefix(obj.Key, prefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+
+	return ret, nil
+}
+
+func (s s3Storage) Stat(name string) (*ObjectInfo, error) {
+	ctx := context.Background()
+	cS3 := cfg.Config.Snapshot.S3
+	bucketPath := fmt.Sprintf("%s/%s", cS3.DirPath, name)
+	info, err := s.mc.StatObject(ctx, cS3.Bucket, bucketPath, minio.StatObjectOptions{})
+	if mErr, ok := err.(minio.ErrorResponse); ok {
+		if mErr.StatusCode == http.StatusNotFound {
+			return nil, ErrNoSnapshotFound
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s s3Storage) Delete(name string) error {
+	ctx := context.Background()
+	cS3 := cfg.Config.Snapshot.S3
+	bucketPath := fmt.Sprintf("%s/%s", cS3.DirPath, name)
+	return s.mc.RemoveObject(ctx, cS3.Bucket, bucketPath, minio.RemoveObjectOptions{})
+}
+
 func newS3Storage() (*s3Storage, error) {
 	c := cfg.Config
 	cS3 := c.Snapshot.S3
@@ -1,6 +1,7 @@
 package snapshot
 
 import (
+	"errors"
 	"net"
 	"net/url"
 	"os"
@@ -77,6 +78,48 @@ func (s *sftpStorage) Download(filePath, name string) error {
 	return err
 }
 
+func (s *sftpStorage) List() ([]*ObjectInfo, error) {
+	files, err := s.client.ReadDir(s.uploadPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*ObjectInfo{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*ObjectInfo, 0, len(files))
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			ret = append(ret, &ObjectInfo{Name: f.Name(), Size: f.Size(), ModTime: f.ModTime()})
+		}
+	}
+
+	return ret, nil
+}
+
+func (s *sftpStorage) Stat(name string) (*ObjectInfo, error) {
+	info, err := s.client.Stat(path.Join(s.uploadPath, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *sftpStorage) Delete(name string) error {
+	err := s.client.Remove(path.Join(s.uploadPath, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
 func newSFTPStorage() (*sftpStorage, error) {
 	// Get the SFTP URL from the environment
 	sftpURL := cfg.Config.Snapshot.SFTP.Url
@@ -0,0 +1,177 @@
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const versionPrefix = "snapshot-"
+const versionTimeFormat = "20060102T150405.000Z"
+
+// Versions named by older versions have no sub-second time, parsing accepts it either way
+const versionParseFormat = "20060102T150405Z"
+const dataSuffix = ".db"
+const manifestSuffix = ".manifest"
+
+// LegacyVersion is snapshot uploaded by older versions under fixed names
+const LegacyVersion = "legacy"
+
+// LatestVersion picks latest valid snapshot
+const LatestVersion = "latest"
+
+type snapshotVersion struct {
+	name   string
+	time   time.Time
+	seq    uint64
+	nodeID uint64
+}
+
+// newSnapshotVersion names snapshot taken by node at t with seq applied, versions order by time
+// then by total of applied sequences then by node
+func newSnapshotVersion(t time.Time, seq map[string]uint64, nodeID uint64) string {
+	total := uint64(0)
+	for _, s := range seq {
+		total += s
+	}
+
+	return fmt.Sprintf("%s-%d-%d", t.UTC().Format(versionTimeFormat), total, nodeID)
+}
+
+func parseSnapshotVersion(name string) (*snapshotVersion, bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, false
+	}
+
+	t, err := time.Parse(versionParseFormat, parts[0])
+	if err != nil {
+		return nil, false
+	}
+
+	v := &snapshotVersion{name: name, time: t}
+	v.seq, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	if len(parts) == 3 {
+		v.nodeID, err = strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func (v *snapshotVersion) newerThan(o *snapshotVersion) bool {
+	if !v.time.Equal(o.time) {
+		return v.time.After(o.time)
+	}
+
+	if v.seq != o.seq {
+		return v.seq > o.seq
+	}
+
+	return v.nodeID > o.nodeID
+}
+
+func dataObjectName(version string) string {
+	if version == LegacyVersion {
+		return snapshotFileName
+	}
+
+	return versionPrefix + version + dataSuffix
+}
+
+func manifestObjectName(version string) string {
+	if version == LegacyVersion {
+		return manifestFileName
+	}
+
+	return versionPrefix + version + manifestSuffix
+}
+
+// versionOf returns version of stored object and whether it's a manifest
+func versionOf(objectName string) (*snapshotVersion, bool, bool) {
+	if !strings.HasPrefix(objectName, versionPrefix) {
+		return nil, false, false
+	}
+
+	name := strings.TrimPrefix(objectName, versionPrefix)
+	isManifest := strings.HasSuffix(name, manifestSuffix)
+	if isManifest {
+		name = strings.TrimSuffix(name, manifestSuffix)
+	} else if strings.HasSuffix(name, dataSuffix) {
+		name = strings.TrimSuffix(name, dataSuffix)
+	} else {
+		return nil, false, false
+	}
+
+	v, ok := parseSnapshotVersion(name)
+	return v, isManifest, ok
+}
+
+// listVersions returns versions with uploaded manifest newest first, manifest is uploaded
+// last so versions without one are incomplete. Legacy snapshot if any comes last.
+func listVersions(objects []*ObjectInfo) []*snapshotVersion {
+	ret := make([]*snapshotVersion, 0)
+	for _, obj := range objects {
+		v, isManifest, ok := versionOf(obj.Name)
+		if ok && isManifest {
+			ret = append(ret, v)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].newerThan(ret[j])
+	})
+
+	for _, obj := range objects {
+		if obj.Name == snapshotFileName {
+			ret = append(ret, &snapshotVersion{name: LegacyVersion, time: obj.ModTime})
+		}
+	}
+
+	return ret
+}
+
+// selectExpiredVersions picks versions beyond keepCount that are older than keepAge at now, along
+// with incomplete uploads older than latest version and legacy snapshot once enough versions
+// exist. It returns names of expired versions and complete versions that are kept, newest first.
+func selectExpiredVersions(
+	objects []*ObjectInfo,
+	keepCount int,
+	keepAge time.Duration,
+	now time.Time,
+) ([]string, []*snapshotVersion) {
+	if keepCount < 1 {
+		keepCount = 1
+	}
+
+	versions := listVersions(objects)
+	expired := make([]string, 0)
+	kept := make([]*snapshotVersion, 0, len(versions))
+	complete := make(map[string]bool)
+	for i, v := range versions {
+		complete[v.name] = true
+		if i >= keepCount && (v.name == LegacyVersion || keepAge == 0 || now.Sub(v.time) > keepAge) {
+			expired = append(expired, v.name)
+			continue
+		}
+
+		kept = append(kept, v)
+	}
+
+	for _, obj := range objects {
+		v, isManifest, ok := versionOf(obj.Name)
+		if ok && !isManifest && !complete[v.name] && len(versions) > 0 && versions[0].newerThan(v) {
+			expired = append(expired, v.name)
+		}
+	}
+
+	return expired, kept
+}
@@ -0,0 +1,206 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSnapshotVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		wantOK bool
+		want   snapshotVersion
+	}{
+		{
+			name:   "current",
+			input:  "20261017T021726.185Z-3-1",
+			wantOK: true,
+			want:   snapshotVersion{time: time.Date(2026, 10, 17, 2, 17, 26, 185e6, time.UTC), seq: 3, nodeID: 1},
+		},
+		{
+			name:   "legacy without milliseconds and node",
+			input:  "20261017T021726Z-42",
+			wantOK: true,
+			want:   snapshotVersion{time: time.Date(2026, 10, 17, 2, 17, 26, 0, time.UTC), seq: 42},
+		},
+		{
+			name:   "milliseconds without node",
+			input:  "20261017T021726.185Z-42",
+			wantOK: true,
+			want:   snapshotVersion{time: time.Date(2026, 10, 17, 2, 17, 26, 185e6, time.UTC), seq: 42},
+		},
+		{name: "missing sequence", input: "20261017T021726.185Z"},
+		{name: "bad time", input: "yesterday-3-1"},
+		{name: "bad sequence", input: "20261017T021726.185Z-x-1"},
+		{name: "bad node", input: "20261017T021726.185Z-3-x"},
+		{name: "too many parts", input: "20261017T021726.185Z-3-1-1"},
+		{name: "legacy fixed name", input: LegacyVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseSnapshotVersion(tt.input)
+			if ok != tt.wantOK {
+				t.Fatalf("parseSnapshotVersion() ok = %v, want %v", ok, tt.wantOK)
+			}
+
+			if !ok {
+				return
+			}
+
+			tt.want.name = tt.input
+			if got.name != tt.want.name || !got.time.Equal(tt.want.time) || got.seq != tt.want.seq || got.nodeID != tt.want.nodeID {
+				t.Errorf("parseSnapshotVersion() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSnapshotVersionRoundTrip(t *testing.T) {
+	at := time.Date(2026, 10, 17, 2, 17, 26, 185999999, time.FixedZone("CEST", 2*3600))
+	name := newSnapshotVersion(at, map[string]uint64{"a": 3, "b": 4}, 9)
+	if name != "20261017T001726.185Z-7-9" {
+		t.Errorf("newSnapshotVersion() = %s", name)
+	}
+
+	v, ok := parseSnapshotVersion(name)
+	if !ok {
+		t.Fatalf("parseSnapshotVersion(%s) failed", name)
+	}
+
+	if !v.time.Equal(at.Truncate(time.Millisecond)) || v.seq != 7 || v.nodeID != 9 {
+		t.Errorf("parseSnapshotVersion() = %+v", *v)
+	}
+}
+
+func TestSnapshotVersionNewerThan(t *testing.T) {
+	at := time.Date(2026, 10, 17, 2, 17, 26, 0, time.UTC)
+	tests := []struct {
+		name string
+		a    snapshotVersion
+		b    snapshotVersion
+		want bool
+	}{
+		{"later time", snapshotVersion{time: at.Add(time.Millisecond)}, snapshotVersion{time: at, seq: 10, nodeID: 10}, true},
+		{"earlier time", snapshotVersion{time: at, seq: 10}, snapshotVersion{time: at.Add(time.Millisecond)}, false},
+		{"same time higher sequence", snapshotVersion{time: at, seq: 2}, snapshotVersion{time: at, seq: 1, nodeID: 5}, true},
+		{"same time and sequence higher node", snapshotVersion{time: at, seq: 1, nodeID: 2}, snapshotVersion{time: at, seq: 1, nodeID: 1}, true},
+		{"same time, sequence and node", snapshotVersion{time: at, seq: 1, nodeID: 1}, snapshotVersion{time: at, seq: 1, nodeID: 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.newerThan(&tt.b); got != tt.want {
+				t.Errorf("newerThan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListVersions(t *testing.T) {
+	objects := []*ObjectInfo{
+		{Name: "snapshot-20261015T000000Z-5.manifest"},
+		{Name: "snapshot-20261015T000000Z-5.db"},
+		{Name: "snapshot-20261017T000000.000Z-9-2.manifest"},
+		{Name: "snapshot-20261017T000000.000Z-9-1.manifest"},
+		{Name: "snapshot-20261018T000000.000Z-9-1.db"},
+		{Name: snapshotFileName},
+		{Name: "chunk-abc"},
+	}
+
+	got := make([]string, 0)
+	for _, v := range listVersions(objects) {
+		got = append(got, v.name)
+	}
+
+	want := []string{"20261017T000000.000Z-9-2", "20261017T000000.000Z-9-1", "20261015T000000Z-5", LegacyVersion}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listVersions() = %v, want %v", got, want)
+	}
+}
+
+func TestSelectExpiredVersions(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	objects := []*ObjectInfo{
+		{Name: "snapshot-20261017T000000.000Z-30-1.manifest"},
+		{Name: "snapshot-20261017T000000.000Z-30-1.db"},
+		{Name: "snapshot-20261016T000000.000Z-20-1.manifest"},
+		{Name: "snapshot-20261016T000000.000Z-20-1.db"},
+		{Name: "snapshot-20261010T000000Z-10.manifest"},
+		{Name: "snapshot-20261010T000000Z-10.db"},
+		// Incomplete, older and newer than latest version
+		{Name: "snapshot-20261012T000000.000Z-15-2.db"},
+		{Name: "snapshot-20261017T060000.000Z-35-2.db"},
+		{Name: snapshotFileName},
+	}
+
+	tests := []struct {
+		name        string
+		keepCount   int
+		keepAge     time.Duration
+		wantExpired []string
+		wantKept    []string
+	}{
+		{
+			name:        "keep count only",
+			keepCount:   2,
+			wantExpired: []string{"20261010T000000Z-10", LegacyVersion, "20261012T000000.000Z-15-2"},
+			wantKept:    []string{"20261017T000000.000Z-30-1", "20261016T000000.000Z-20-1"},
+		},
+		{
+			name:        "keep age keeps recent versions beyond count",
+			keepCount:   1,
+			keepAge:     2 * day,
+			wantExpired: []string{"20261010T000000Z-10", LegacyVersion, "20261012T000000.000Z-15-2"},
+			wantKept:    []string{"20261017T000000.000Z-30-1", "20261016T000000.000Z-20-1"},
+		},
+		{
+			name:        "keep age keeps everything",
+			keepCount:   1,
+			keepAge:     30 * day,
+			wantExpired: []string{LegacyVersion, "20261012T000000.000Z-15-2"},
+			wantKept:    []string{"20261017T000000.000Z-30-1", "20261016T000000.000Z-20-1", "20261010T000000Z-10"},
+		},
+		{
+			name:        "zero keep count keeps latest",
+			keepCount:   0,
+			wantExpired: []string{"20261016T000000.000Z-20-1", "20261010T000000Z-10", LegacyVersion, "20261012T000000.000Z-15-2"},
+			wantKept:    []string{"20261017T000000.000Z-30-1"},
+		},
+		{
+			name:        "legacy kept within count",
+			keepCount:   4,
+			wantExpired: []string{"20261012T000000.000Z-15-2"},
+			wantKept:    []string{"20261017T000000.000Z-30-1", "20261016T000000.000Z-20-1", "20261010T000000Z-10", LegacyVersion},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expired, kept := selectExpiredVersions(objects, tt.keepCount, tt.keepAge, now)
+			if !reflect.DeepEqual(expired, tt.wantExpired) {
+				t.Errorf("expired = %v, want %v", expired, tt.wantExpired)
+			}
+
+			keptNames := make([]string, 0, len(kept))
+			for _, v := range kept {
+				keptNames = append(keptNames, v.name)
+			}
+
+			if !reflect.DeepEqual(keptNames, tt.wantKept) {
+				t.Errorf("kept = %v, want %v", keptNames, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestSelectExpiredVersionsWithoutVersions(t *testing.T) {
+	objects := []*ObjectInfo{{Name: "snapshot-20261017T000000.000Z-35-2.db"}}
+	expired, kept := selectExpiredVersions(objects, 1, 0, time.Now())
+	if len(expired) != 0 || len(kept) != 0 {
+		t.Errorf("selectExpiredVersions() = %v, %v, want nothing", expired, kept)
+	}
+}
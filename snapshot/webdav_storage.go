@@ -86,6 +86,58 @@ func (w *webDAVStorage) Download(filePath, name string) error {
 	return nil
 }
 
+func (w *webDAVStorage) List() ([]*ObjectInfo, error) {
+	files, err := w.client.ReadDir(path.Join("/", w.path))
+	if isWebDAVNotFound(err) {
+		return []*ObjectInfo{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*ObjectInfo, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() {
+			ret = append(ret, &ObjectInfo{Name: f.Name(), Size: f.Size(), ModTime: f.ModTime()})
+		}
+	}
+
+	return ret, nil
+}
+
+func (w *webDAVStorage) Stat(name string) (*ObjectInfo, error) {
+	info, err := w.client.Stat(path.Join("/", w.path, name))
+	if isWebDAVNotFound(err) {
+		return nil, ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (w *webDAVStorage) Delete(name string) error {
+	err := w.client.Remove(path.Join("/", w.path, name))
+	if isWebDAVNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func isWebDAVNotFound(err error) bool {
+	if fsErr, ok := err.(*fs.PathError); ok {
+		if wdErr, ok := fsErr.Err.(gowebdav.StatusError); ok && wdErr.Status == 404 {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (w *webDAVStorage) makeStoragePath() error {
 	err := w.client.MkdirAll(w.path, 0740)
 	if err == nil {